@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API listens on its own address so it never has to be
+// exposed to the internet along with the webhook. It is only started
+// if ADMIN_TOKEN is set.
+var ADMIN_ADDR string = "127.0.0.1:8081"
+
+// Number of conversations we keep around for the admin API
+var MAX_RECENT_CONVERSATIONS int = 20
+
+// Set through the admin API. While paused, James still receives
+// webhook events but doesn't reply to them
+var repliesPaused int32
+
+func isPaused() bool {
+	return atomic.LoadInt32(&repliesPaused) == 1
+}
+
+func setPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&repliesPaused, 1)
+	} else {
+		atomic.StoreInt32(&repliesPaused, 0)
+	}
+}
+
+type Conversation struct {
+	TweetID       int64     `json:"tweet_id"`
+	UserID        int64     `json:"user_id"`
+	Lines         []Line    `json:"lines"`
+	Response      string    `json:"response"`
+	Model         string    `json:"model"`
+	InputVerdict  Verdict   `json:"input_verdict"`
+	OutputVerdict Verdict   `json:"output_verdict"`
+	Time          time.Time `json:"time"`
+}
+
+var (
+	recentConversations   []Conversation
+	recentConversationsMu sync.Mutex
+)
+
+// Keeps the last MAX_RECENT_CONVERSATIONS replies James made,
+// newest last
+func recordConversation(c Conversation) {
+	recentConversationsMu.Lock()
+	defer recentConversationsMu.Unlock()
+
+	recentConversations = append(recentConversations, c)
+	if over := len(recentConversations) - MAX_RECENT_CONVERSATIONS; over > 0 {
+		recentConversations = recentConversations[over:]
+	}
+}
+
+func getRecentConversations() []Conversation {
+	recentConversationsMu.Lock()
+	defer recentConversationsMu.Unlock()
+
+	return append([]Conversation{}, recentConversations...)
+}
+
+func startAdminServer() {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		slog.Warn("ADMIN_TOKEN not set, admin API disabled")
+		return
+	}
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		ADMIN_ADDR = addr
+	}
+
+	slog.Info("Starting admin API", "addr", ADMIN_ADDR)
+	log.Fatal(http.ListenAndServe(ADMIN_ADDR, adminAuth(token, adminRoutes())))
+}
+
+func adminRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/config", adminConfigHandler)
+	mux.HandleFunc("/admin/queue", adminQueueHandler)
+	mux.HandleFunc("/admin/conversations", adminConversationsHandler)
+	mux.HandleFunc("/admin/moderation", adminModerationHandler)
+	mux.HandleFunc("/admin/approvals", adminApprovalsHandler)
+	mux.HandleFunc("/admin/cache", adminCacheHandler)
+	mux.HandleFunc("/admin/usage", adminUsageHandler)
+	mux.HandleFunc("/admin/pause", adminPauseHandler(true))
+	mux.HandleFunc("/admin/resume", adminPauseHandler(false))
+	mux.HandleFunc("/admin/posts", adminPostsHandler)
+	mux.HandleFunc("/admin/users/whitelisted", adminWhitelistHandler)
+	mux.HandleFunc("/admin/users/tracked", adminTrackedHandler)
+	mux.HandleFunc("/admin/webhook", adminWebhookHandler)
+	return mux
+}
+
+// Every admin request needs "Authorization: Bearer <ADMIN_TOKEN>"
+func adminAuth(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing admin response", "err", err)
+	}
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
+	writeJSON(w, struct {
+		EnvName              string   `json:"env_name"`
+		WebhookURL           string   `json:"webhook_url"`
+		MaxTweetTokens       int      `json:"max_tweet_tokens"`
+		MaxCompletionRetries int      `json:"max_completion_retries"`
+		DefaultResponse      string   `json:"default_response"`
+		TwitterAPIVersion    string   `json:"twitter_api_version"`
+		ReplyModel           string   `json:"reply_model"`
+		ReplyFallbackModels  []string `json:"reply_fallback_models"`
+		Models               []*Model `json:"models"`
+		WhitelistedUsers     []User   `json:"whitelisted_users"`
+		TrackedUsers         []User   `json:"tracked_users"`
+		Paused               bool     `json:"paused"`
+	}{
+		EnvName:              ENV_NAME,
+		WebhookURL:           WEBHOOK_URL,
+		MaxTweetTokens:       MAX_TWEET_TOKENS,
+		MaxCompletionRetries: MAX_COMPLETION_RETRIES,
+		DefaultResponse:      DEFAULT_RESPONSE,
+		TwitterAPIVersion:    TWITTER_API_VERSION,
+		ReplyModel:           REPLY_MODEL,
+		ReplyFallbackModels:  REPLY_FALLBACK_MODELS,
+		Models:               Models.List(),
+		WhitelistedUsers:     WHITELISTED_USERS,
+		TrackedUsers:         USERS_TRACKING,
+		Paused:               isPaused(),
+	})
+}
+
+func adminQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+
+	writeJSON(w, struct {
+		Depth    int `json:"depth"`
+		Capacity int `json:"capacity"`
+	}{len(JamesBuffer), cap(JamesBuffer)})
+}
+
+func adminConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, getRecentConversations())
+}
+
+// The latest texts moderation flagged, and why
+func adminModerationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, getRecentVerdicts())
+}
+
+// GET lists the tweets waiting for approval. POST with ?id= and
+// ?action=approve or reject decides on one. Approving posts the
+// suggested text, or the text form value if there is one.
+func adminApprovalsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, Approvals.List())
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != "approve" && action != "reject" {
+		http.Error(w, `action has to be "approve" or "reject"`, http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	text := r.FormValue("text")
+	if action == "approve" && text == "" {
+		// Check before taking it off the queue, so it isn't lost
+		for _, p := range Approvals.List() {
+			if p.ID == id && p.Suggested == "" {
+				http.Error(w, "nothing suggested, text is required", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	p, ok := Approvals.Take(id)
+	if !ok {
+		http.Error(w, "no tweet waiting for approval with that id", http.StatusNotFound)
+		return
+	}
+
+	ctx := withCorrelationID(r.Context(), newCorrelationID())
+	if action == "reject" {
+		logger(ctx).Info("Tweet rejected through admin API", "approval_id", id)
+		writeJSON(w, p)
+		return
+	}
+
+	posted, err := postApproved(ctx, p, text)
+	if err != nil {
+		// Back on the queue so it can be tried again, under a new id
+		requeued := Approvals.Add(p)
+		logger(ctx).Error("Error posting approved tweet", "approval_id", id,
+			"requeued_id", requeued.ID, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	logger(ctx).Info("Tweet approved through admin API", "approval_id", id, "tweet_id", posted.ID)
+	writeJSON(w, posted)
+}
+
+// Tokens and dollars spent per day, user, template and model,
+// and the budgets they count towards
+func adminUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET") {
+		return
+	}
+	writeJSON(w, Spending.Report(time.Now()))
+}
+
+// GET shows how many completions are cached, DELETE drops them all
+func adminCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET", "DELETE") {
+		return
+	}
+	if Cache == nil {
+		http.Error(w, "the completion cache is off", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := Cache.Clear(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Completion cache cleared through admin API")
+	}
+	writeJSON(w, struct {
+		Entries    int    `json:"entries"`
+		MaxEntries int    `json:"max_entries"`
+		TTL        string `json:"ttl"`
+	}{Cache.Len(), Cache.maxEntries, Cache.ttl.String()})
+}
+
+func adminPauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+		setPaused(paused)
+		slog.Info("Replies paused through admin API", "paused", paused)
+		writeJSON(w, struct {
+			Paused bool `json:"paused"`
+		}{paused})
+	}
+}
+
+// GET lists the scheduled posts, POST with ?name= makes one right away.
+// Posting takes as long as a completion, so we only kick it off here.
+func adminPostsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET", "POST") {
+		return
+	}
+
+	if r.Method == "GET" {
+		posts := []*ScheduledPost{}
+		for _, post := range SCHEDULED_POSTS {
+			posts = append(posts, post)
+		}
+		sort.Slice(posts, func(i, j int) bool { return posts[i].Name < posts[j].Name })
+		writeJSON(w, posts)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	post, ok := SCHEDULED_POSTS[name]
+	if !ok {
+		http.Error(w, "no scheduled post named "+strconv.Quote(name), http.StatusNotFound)
+		return
+	}
+
+	ctx := withCorrelationID(context.Background(), newCorrelationID())
+	logger(ctx).Info("Scheduled post triggered through admin API", "post", name)
+	go func() {
+		if err := post.run(ctx); err != nil {
+			logger(ctx).Error("Error making scheduled post", "post", name, "err", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func adminWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "POST") {
+		return
+	}
+
+	slog.Info("Re-registering webhook through admin API")
+	if err := registerWebhook(); err != nil {
+		slog.Error("Error registering webhook", "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET lists the whitelist, POST and DELETE take an "id" form value
+func adminWhitelistHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+
+	if r.Method == "GET" {
+		usersMu.RLock()
+		defer usersMu.RUnlock()
+		writeJSON(w, WHITELISTED_USERS)
+		return
+	}
+
+	u, err := parseUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usersMu.Lock()
+	if r.Method == "POST" {
+		WHITELISTED_USERS = addUser(WHITELISTED_USERS, u)
+	} else {
+		WHITELISTED_USERS = removeUser(WHITELISTED_USERS, u)
+	}
+	usersMu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Tracking a user means subscribing to their account activity, which
+// needs the user's own access token. POST takes "id", "access_token" and
+// "access_token_secret" form values, DELETE only "id".
+func adminTrackedHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, "GET", "POST", "DELETE") {
+		return
+	}
+
+	if r.Method == "GET" {
+		usersMu.RLock()
+		defer usersMu.RUnlock()
+		writeJSON(w, USERS_TRACKING)
+		return
+	}
+
+	u, err := parseUserID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		creds := Credentials{
+			ConsumerKey:       os.Getenv("CONSUMER_KEY"),
+			ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
+			AccessToken:       r.FormValue("access_token"),
+			AccessTokenSecret: r.FormValue("access_token_secret"),
+		}
+		if creds.AccessToken == "" || creds.AccessTokenSecret == "" {
+			http.Error(w, "access_token and access_token_secret are required",
+				http.StatusBadRequest)
+			return
+		}
+
+		client, err := Twitter.WithUser(r.Context(), creds)
+		if err == nil {
+			err = client.Subscribe(r.Context())
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// Tracked users also need to be whitelisted for James to reply
+		usersMu.Lock()
+		USERS_TRACKING = addUser(USERS_TRACKING, u)
+		WHITELISTED_USERS = addUser(WHITELISTED_USERS, u)
+		usersMu.Unlock()
+	} else {
+		if err := Twitter.Unsubscribe(r.Context(), u.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		usersMu.Lock()
+		USERS_TRACKING = removeUser(USERS_TRACKING, u)
+		usersMu.Unlock()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseUserID(r *http.Request) (User, error) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		return User{}, errors.New("Invalid user id: " + r.FormValue("id"))
+	}
+	return User{ID: id}, nil
+}
+
+func addUser(list []User, u User) []User {
+	if contains(list, u) {
+		return list
+	}
+	return append(list, u)
+}
+
+func removeUser(list []User, u User) []User {
+	filtered := []User{}
+	for _, l := range list {
+		if l.ID != u.ID {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Max tweets waiting for approval. The oldest is dropped past that.
+var MAX_PENDING_APPROVALS int = 100
+
+// A tweet James wanted to post but that needs a human to look at it
+// first, i.e. a reply moderation kept flagging. Only kept in memory,
+// whatever is pending when James restarts is dropped.
+type PendingTweet struct {
+	ID        int64  `json:"id"`
+	Kind      string `json:"kind"`
+	InReplyTo int64  `json:"in_reply_to,omitempty"`
+	User      User   `json:"user"`
+	// Posted on approval unless the admin sends their own text
+	Suggested string    `json:"suggested"`
+	Verdict   Verdict   `json:"verdict"`
+	Time      time.Time `json:"time"`
+}
+
+type ApprovalQueue struct {
+	mu      sync.Mutex
+	nextID  int64
+	pending []PendingTweet
+}
+
+var Approvals = &ApprovalQueue{nextID: 1}
+
+func (q *ApprovalQueue) Add(p PendingTweet) PendingTweet {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p.ID = q.nextID
+	q.nextID++
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+
+	q.pending = append(q.pending, p)
+	if over := len(q.pending) - MAX_PENDING_APPROVALS; over > 0 {
+		q.pending = q.pending[over:]
+	}
+	approvalsPending.Set(float64(len(q.pending)))
+	return p
+}
+
+func (q *ApprovalQueue) List() []PendingTweet {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]PendingTweet{}, q.pending...)
+}
+
+// Removes a tweet from the queue, so it's either posted or dropped
+// exactly once
+func (q *ApprovalQueue) Take(id int64) (PendingTweet, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, p := range q.pending {
+		if p.ID == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			approvalsPending.Set(float64(len(q.pending)))
+			return p, true
+		}
+	}
+	return PendingTweet{}, false
+}
+
+// Posts an approved tweet, with text instead of the suggestion if given
+func postApproved(ctx context.Context, p PendingTweet, text string) (Tweet, error) {
+	if text == "" {
+		text = p.Suggested
+	}
+	posted, err := Twitter.PostStatus(ctx, text, p.InReplyTo)
+	recordTweetPost(p.Kind, posted, err)
+	return posted, err
+}
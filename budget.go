@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where token usage is kept. Can be overridden with USAGE_PATH.
+var USAGE_PATH string = "usage.json"
+
+// Days of usage kept, enough for the monthly budget
+var USAGE_HISTORY_DAYS int = 62
+
+// Returned instead of a completion when a budget is used up
+var ErrOverBudget = errors.New("over budget")
+
+// Spending limits, in dollars. Budgets left out or 0 have no limit.
+// Days and months are UTC.
+//
+//	"budget": {
+//	  "daily": 2.5,
+//	  "monthly": 50,
+//	  "user_daily": 0.25,
+//	  "degrade_at": 0.8,
+//	  "degrade_model": "gpt-4o-mini"
+//	}
+type BudgetConfig struct {
+	Daily   float64 `json:"daily"`
+	Monthly float64 `json:"monthly"`
+	// Most the replies to a single user can cost in a day
+	UserDaily float64 `json:"user_daily"`
+	// Once this fraction of the daily or monthly budget is spent,
+	// requests use DegradeModel if it's cheaper than the one they
+	// asked for. Past the budget itself James stops completing
+	// until the next day or month.
+	DegradeAt    float64 `json:"degrade_at"`
+	DegradeModel string  `json:"degrade_model"`
+}
+
+func (c *BudgetConfig) validate(models *ModelRegistry) error {
+	if c.Daily < 0 || c.Monthly < 0 || c.UserDaily < 0 {
+		return errors.New("Budgets can't be negative")
+	}
+	if c.DegradeAt < 0 || c.DegradeAt > 1 {
+		return errors.New("Budget degrade_at has to be between 0 and 1")
+	}
+	if c.DegradeModel != "" {
+		if _, err := models.Get(c.DegradeModel); err != nil {
+			return fmt.Errorf("Budget degrade model: %w", err)
+		}
+	}
+	return nil
+}
+
+type Spend struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (s *Spend) add(other Spend) {
+	s.Requests += other.Requests
+	s.PromptTokens += other.PromptTokens
+	s.CompletionTokens += other.CompletionTokens
+	s.Cost += other.Cost
+}
+
+// Everything spent in a day, and who and what it was spent on
+type DayUsage struct {
+	Spend
+	Users     map[int64]*Spend  `json:"users"`
+	Templates map[string]*Spend `json:"templates"`
+	Models    map[string]*Spend `json:"models"`
+}
+
+type SpendingLedger struct {
+	mu     sync.Mutex
+	path   string
+	budget BudgetConfig
+	// Date (2006-01-02) to usage
+	days map[string]*DayUsage
+}
+
+// Usage of every completion. Set in main.
+var Spending *SpendingLedger
+
+func NewSpendingLedger(path string, budget *BudgetConfig) (*SpendingLedger, error) {
+	l := &SpendingLedger{path: path, days: map[string]*DayUsage{}}
+	if budget != nil {
+		l.budget = *budget
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return l, json.Unmarshal(data, &l.days)
+}
+
+func dayKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Adds a completion call and saves the ledger. Returns what the call
+// cost. If saving fails the usage still counts until James restarts.
+func (l *SpendingLedger) Record(now time.Time, m *Model, template string, userID int64, usage Usage) (float64, error) {
+	if l == nil {
+		return m.Cost(usage.PromptTokens, usage.CompletionTokens), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	spend := Spend{
+		Requests:         1,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		Cost:             m.Cost(usage.PromptTokens, usage.CompletionTokens),
+	}
+
+	key := dayKey(now)
+	day, ok := l.days[key]
+	if !ok {
+		day = &DayUsage{
+			Users:     map[int64]*Spend{},
+			Templates: map[string]*Spend{},
+			Models:    map[string]*Spend{},
+		}
+		l.days[key] = day
+	}
+	day.add(spend)
+	if userID != 0 {
+		if day.Users[userID] == nil {
+			day.Users[userID] = &Spend{}
+		}
+		day.Users[userID].add(spend)
+	}
+	if template == "" {
+		template = "none"
+	}
+	if day.Templates[template] == nil {
+		day.Templates[template] = &Spend{}
+	}
+	day.Templates[template].add(spend)
+	if day.Models[m.Name] == nil {
+		day.Models[m.Name] = &Spend{}
+	}
+	day.Models[m.Name].add(spend)
+
+	// Dates sort the same as strings
+	oldest := dayKey(now.AddDate(0, 0, -USAGE_HISTORY_DAYS))
+	for k := range l.days {
+		if k < oldest {
+			delete(l.days, k)
+		}
+	}
+	return spend.Cost, writeJSONFile(l.path, l.days)
+}
+
+func (l *SpendingLedger) today(now time.Time) Spend {
+	if day, ok := l.days[dayKey(now)]; ok {
+		return day.Spend
+	}
+	return Spend{}
+}
+
+func (l *SpendingLedger) month(now time.Time) Spend {
+	month := now.UTC().Format("2006-01")
+	total := Spend{}
+	for k, day := range l.days {
+		if strings.HasPrefix(k, month) {
+			total.add(day.Spend)
+		}
+	}
+	return total
+}
+
+// Whether the daily or monthly budget is used up
+func (l *SpendingLedger) OverBudget(now time.Time) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.overBudget(now) != nil
+}
+
+func (l *SpendingLedger) overBudget(now time.Time) error {
+	if spent := l.today(now).Cost; l.budget.Daily > 0 && spent >= l.budget.Daily {
+		return fmt.Errorf("%w: spent $%.2f of the $%.2f daily budget", ErrOverBudget, spent, l.budget.Daily)
+	}
+	if spent := l.month(now).Cost; l.budget.Monthly > 0 && spent >= l.budget.Monthly {
+		return fmt.Errorf("%w: spent $%.2f of the $%.2f monthly budget", ErrOverBudget, spent, l.budget.Monthly)
+	}
+	return nil
+}
+
+// Decides which model a request gets, given what's left of the
+// budgets. Returns an error wrapping ErrOverBudget if it gets none.
+// Free models always get through.
+func (l *SpendingLedger) Plan(now time.Time, m *Model, userID int64) (*Model, error) {
+	if l == nil {
+		return m, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if m.free() {
+		return m, nil
+	}
+	if err := l.overBudget(now); err != nil {
+		return nil, err
+	}
+	if day, ok := l.days[dayKey(now)]; ok && userID != 0 && l.budget.UserDaily > 0 {
+		if spent := day.Users[userID]; spent != nil && spent.Cost >= l.budget.UserDaily {
+			return nil, fmt.Errorf("%w: user %v spent $%.2f of the $%.2f user budget",
+				ErrOverBudget, userID, spent.Cost, l.budget.UserDaily)
+		}
+	}
+
+	if l.budget.DegradeModel == "" {
+		return m, nil
+	}
+	nearDaily := l.budget.Daily > 0 && l.today(now).Cost >= l.budget.DegradeAt*l.budget.Daily
+	nearMonthly := l.budget.Monthly > 0 && l.month(now).Cost >= l.budget.DegradeAt*l.budget.Monthly
+	if !nearDaily && !nearMonthly {
+		return m, nil
+	}
+	cheaper, err := Models.Get(l.budget.DegradeModel)
+	if err != nil {
+		return m, nil
+	}
+	if cheaper.PromptPrice+cheaper.CompletionPrice < m.PromptPrice+m.CompletionPrice {
+		return cheaper, nil
+	}
+	return m, nil
+}
+
+// What the admin API shows
+type SpendingReport struct {
+	Budget BudgetConfig `json:"budget"`
+	Today  Spend        `json:"today"`
+	Month  Spend        `json:"month"`
+	// Newest first
+	Days []DayReport `json:"days"`
+}
+
+type DayReport struct {
+	Date string `json:"date"`
+	DayUsage
+}
+
+func (l *SpendingLedger) Report(now time.Time) SpendingReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := SpendingReport{
+		Budget: l.budget,
+		Today:  l.today(now),
+		Month:  l.month(now),
+		Days:   []DayReport{},
+	}
+	// Copied, the ledger keeps changing while the report is encoded
+	for k, day := range l.days {
+		d := DayReport{Date: k, DayUsage: DayUsage{
+			Spend:     day.Spend,
+			Users:     map[int64]*Spend{},
+			Templates: map[string]*Spend{},
+			Models:    map[string]*Spend{},
+		}}
+		for id, s := range day.Users {
+			spend := *s
+			d.Users[id] = &spend
+		}
+		for name, s := range day.Templates {
+			spend := *s
+			d.Templates[name] = &spend
+		}
+		for name, s := range day.Models {
+			spend := *s
+			d.Models[name] = &spend
+		}
+		report.Days = append(report.Days, d)
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Date > report.Days[j].Date })
+	return report
+}
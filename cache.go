@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Where cached completions are kept. Can be overridden with
+// COMPLETION_CACHE_PATH.
+var COMPLETION_CACHE_PATH string = "completion_cache.json"
+
+// Templates with a temperature above this are creative, they aren't
+// cached unless the config says so. Caching them would only make
+// James repeat himself.
+var CACHE_MAX_TEMPERATURE float32 = 0.5
+
+// Completions for a prompt James has seen before are answered from the
+// cache instead of the API, i.e. webhook deliveries Twitter retries or
+// the same "tell me a joke" from different people. Left out of the
+// config, nothing is cached.
+//
+//	"cache": {
+//	  "ttl": "24h",
+//	  "max_entries": 500,
+//	  "templates": {"standard": true, "horoscope": false}
+//	}
+type CacheConfig struct {
+	TTL        Duration `json:"ttl"`
+	MaxEntries int      `json:"max_entries"`
+	// Template (or scheduled post) names to whether their completions
+	// are cached. The ones not listed are cached unless they're
+	// creative, see CACHE_MAX_TEMPERATURE.
+	Templates map[string]bool `json:"templates"`
+}
+
+type cacheEntry struct {
+	Model      string      `json:"model"`
+	Candidates []Candidate `json:"candidates"`
+	Created    time.Time   `json:"created"`
+	Expires    time.Time   `json:"expires"`
+	LastUsed   time.Time   `json:"last_used"`
+}
+
+type CompletionCache struct {
+	mu         sync.Mutex
+	path       string
+	ttl        time.Duration
+	maxEntries int
+	templates  map[string]bool
+	// Key (see cacheKey) to entry
+	entries map[string]*cacheEntry
+}
+
+// Set in main, nil if the config has no cache section
+var Cache *CompletionCache
+
+func NewCompletionCache(path string, c *CacheConfig) (*CompletionCache, error) {
+	if c.TTL <= 0 {
+		return nil, errors.New("Cache needs a ttl")
+	}
+	if c.MaxEntries <= 0 {
+		return nil, errors.New("Cache needs max_entries")
+	}
+	cache := &CompletionCache{
+		path:       path,
+		ttl:        time.Duration(c.TTL),
+		maxEntries: c.MaxEntries,
+		templates:  c.Templates,
+		entries:    map[string]*cacheEntry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, err
+	}
+
+	// Whatever expired while James was down
+	now := time.Now()
+	for key, entry := range cache.entries {
+		if now.After(entry.Expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.evict()
+	return cache, nil
+}
+
+// Whether completions of a template are cached
+func (c *CompletionCache) Enabled(template string, temperature float32) bool {
+	if c == nil {
+		return false
+	}
+	if enabled, ok := c.templates[template]; ok {
+		return enabled
+	}
+	return temperature <= CACHE_MAX_TEMPERATURE
+}
+
+// Everything that changes what the API would answer goes in the key.
+// User doesn't, so everyone asking the same thing shares an entry.
+func cacheKey(m *Model, request CompletionRequest, prompt string, messages []ChatMessage) string {
+	data, _ := json.Marshal(struct {
+		Model            string
+		Temperature      float32
+		TopP             float32
+		PresencePenalty  float32
+		FrequencyPenalty float32
+		LogitBias        map[string]int
+		BestOf           int
+		Tokens           int
+		Stop             []string
+		FilterRegex      string
+		Candidates       int
+		LogProbs         bool
+		Prompt           string
+		Messages         []ChatMessage
+	}{m.ID, request.Temperature, request.TopP, request.PresencePenalty, request.FrequencyPenalty,
+		request.LogitBias, request.BestOf, request.Tokens, request.Stop, request.FilterRegex,
+		request.Candidates, request.LogProbs, prompt, messages})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *CompletionCache) Get(key string, now time.Time) ([]Candidate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(entry.Expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	entry.LastUsed = now
+	return append([]Candidate{}, entry.Candidates...), true
+}
+
+// Adds the completion and saves the cache. If saving fails the
+// completion is still cached until James restarts.
+func (c *CompletionCache) Put(key string, model string, candidates []Candidate, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &cacheEntry{
+		Model:      model,
+		Candidates: candidates,
+		Created:    now,
+		Expires:    now.Add(c.ttl),
+		LastUsed:   now,
+	}
+	c.evict()
+	return writeJSONFile(c.path, c.entries)
+}
+
+// Drops the least recently used entries past maxEntries
+func (c *CompletionCache) evict() {
+	for len(c.entries) > c.maxEntries {
+		oldest := ""
+		for key, entry := range c.entries {
+			if oldest == "" || entry.LastUsed.Before(c.entries[oldest].LastUsed) {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+func (c *CompletionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+func (c *CompletionCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*cacheEntry{}
+	return writeJSONFile(c.path, c.entries)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The go-gpt3 client predates chat models, so those are called directly
+var OPENAI_CHAT_URL string = "https://api.openai.com/v1/chat/completions"
+
+var openAIHTTP = &http.Client{Timeout: time.Minute}
+
+type ChatMessage struct {
+	// "system", "user" or "assistant"
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Temperature float32       `json:"temperature"`
+	Stop        []string      `json:"stop,omitempty"`
+	N           int           `json:"n,omitempty"`
+	Logprobs    bool          `json:"logprobs,omitempty"`
+
+	TopP             float32        `json:"top_p,omitempty"`
+	PresencePenalty  float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32        `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]int `json:"logit_bias,omitempty"`
+	User             string         `json:"user,omitempty"`
+
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message      ChatMessage     `json:"message"`
+		FinishReason string          `json:"finish_reason"`
+		Logprobs     *choiceLogprobs `json:"logprobs"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// The persona goes in the system message, then every line of the
+// conversation is a message from the user or from James
+func chatMessages(system string, lines []Line) []ChatMessage {
+	messages := []ChatMessage{}
+	if system != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: system})
+	}
+	for _, line := range lines {
+		role := "user"
+		if line.IsJames {
+			role = "assistant"
+		}
+		messages = append(messages, ChatMessage{Role: role, Content: line.Text})
+	}
+	return messages
+}
+
+func createChatCompletion(ctx context.Context, url string, apiKey string, req chatRequest) (chatResponse, error) {
+	resp := chatResponse{}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	httpResp, err := openAIHTTP.Do(httpReq)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, fmt.Errorf("Chat completion returned %v: %s", httpResp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	if resp.Error != nil {
+		return resp, fmt.Errorf("Chat completion returned %v: %v", httpResp.StatusCode, resp.Error.Message)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("Chat completion returned %v", httpResp.StatusCode)
+	}
+	if len(resp.Choices) == 0 {
+		return resp, errors.New("Chat completion returned no choices")
+	}
+	return resp, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Path of the JSON config file. Can be overridden with CONFIG_PATH.
+// If the file doesn't exist James runs with the defaults.
+var CONFIG_PATH string = "config.json"
+
+// Everything that can be changed without touching Go code. Fields
+// left out of the file keep their defaults.
+//
+//	{
+//	  "scheduled_posts": [{
+//	    "name": "joke",
+//	    "schedule": "0 12 * * *",
+//	    "time_zone": "America/Chicago",
+//	    "jitter": "10m",
+//	    "template": "Tell a joke about {{.Date.Format \"January\"}}:\n\n",
+//	    "model": "davinci-instruct-beta",
+//	    "temperature": 0.8,
+//	    "filter_regex": "\\n",
+//	    "target": "timeline"
+//	  }]
+//	}
+type Config struct {
+	Models              []*Model           `json:"models"`
+	ReplyModel          string             `json:"reply_model"`
+	ReplyFallbackModels []string           `json:"reply_fallback_models"`
+	ReplySampling       *Sampling          `json:"reply_sampling"`
+	ScheduledPosts      []*ScheduledPost   `json:"scheduled_posts"`
+	Moderation          *ModerationConfig  `json:"moderation"`
+	Fallback            *FallbackConfig    `json:"fallback"`
+	Rerank              *RerankConfig      `json:"rerank"`
+	Cache               *CacheConfig       `json:"cache"`
+	Budget              *BudgetConfig      `json:"budget"`
+	ReplyLimits         *ReplyLimitsConfig `json:"reply_limits"`
+	PostProcessing      *PostProcessConfig `json:"post_processing"`
+
+	// The default models plus the ones from the config
+	Registry *ModelRegistry `json:"-"`
+}
+
+// Durations are written like "5m" or "1h30m" in the config
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func loadConfig(path string) (Config, error) {
+	config := Config{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	if config.Registry, err = newModelRegistry(config.Models); err != nil {
+		return config, err
+	}
+	if config.ReplyModel != "" {
+		if _, err := config.Registry.Get(config.ReplyModel); err != nil {
+			return config, err
+		}
+	}
+	for _, name := range config.ReplyFallbackModels {
+		if _, err := config.Registry.Get(name); err != nil {
+			return config, err
+		}
+	}
+	if config.ReplySampling != nil {
+		if err := config.ReplySampling.validate(); err != nil {
+			return config, fmt.Errorf("Reply sampling: %w", err)
+		}
+	}
+
+	if config.Budget != nil {
+		if err := config.Budget.validate(config.Registry); err != nil {
+			return config, err
+		}
+	}
+
+	if config.ReplyLimits == nil {
+		config.ReplyLimits = DEFAULT_REPLY_LIMITS
+	}
+	if err := config.ReplyLimits.validate(); err != nil {
+		return config, err
+	}
+
+	if config.PostProcessing == nil {
+		config.PostProcessing = DEFAULT_POST_PROCESSING
+	}
+	if _, err := newPostProcessChain(config.PostProcessing); err != nil {
+		return config, err
+	}
+
+	if config.ScheduledPosts == nil {
+		config.ScheduledPosts = DEFAULT_SCHEDULED_POSTS
+	}
+	if config.Fallback == nil {
+		config.Fallback = DEFAULT_FALLBACK
+	}
+	if config.Rerank == nil {
+		config.Rerank = DEFAULT_RERANK
+	}
+	if config.Moderation == nil {
+		config.Moderation = DEFAULT_MODERATION
+	}
+	if err := config.Moderation.compile(); err != nil {
+		return config, err
+	}
+	for _, post := range config.ScheduledPosts {
+		if err := post.compile(config.Registry); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// Writes v as JSON to a temporary file and renames it over path,
+// so a crash never leaves a half written file
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
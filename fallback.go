@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Used when the config has no fallback section
+var DEFAULT_FALLBACK = &FallbackConfig{
+	Action: "respond",
+	Responses: []string{
+		DEFAULT_RESPONSE,
+		"Ask me again later {{.User.ScreenName}}, I'm busy contemplating the void",
+		"Hmm, I'd rather not. Try me with something else?",
+		"My lawyer has advised me not to answer that one",
+		"Let's pretend you never asked and I never answered",
+		"I started writing a reply, then decided to take a nap instead",
+	},
+	AvoidRecent: 3,
+}
+
+// What James does when moderation keeps flagging his completions
+// and MAX_COMPLETION_RETRIES runs out
+//
+//	"fallback": {
+//	  "action": "respond",
+//	  "responses": ["Not today {{.User.ScreenName}}", "*Yaaaawn*"],
+//	  "avoid_recent": 1
+//	}
+type FallbackConfig struct {
+	// "respond" with one of the responses, stay "silent", or hold
+	// the reply for "approval" through the admin API
+	Action string `json:"action"`
+	// text/templates executed with FallbackData
+	Responses []string `json:"responses"`
+	// How many of the last used responses won't be picked again
+	AvoidRecent int `json:"avoid_recent"`
+}
+
+type FallbackData struct {
+	User User
+}
+
+type FallbackPool struct {
+	mu          sync.Mutex
+	action      string
+	responses   []*template.Template
+	avoidRecent int
+	// Indexes of the last responses used, newest last
+	recent []int
+}
+
+// The fallbacks used for replies, and scheduled posts without their
+// own. Set in main.
+var Fallbacks *FallbackPool
+
+func newFallbackPool(c *FallbackConfig) (*FallbackPool, error) {
+	pool := &FallbackPool{action: c.Action, avoidRecent: c.AvoidRecent}
+
+	switch c.Action {
+	case "":
+		pool.action = "respond"
+	case "respond", "silent", "approval":
+	default:
+		return nil, fmt.Errorf("Unknown fallback action %q", c.Action)
+	}
+	if pool.action == "respond" && len(c.Responses) == 0 {
+		return nil, errors.New("Fallback needs responses to respond with")
+	}
+
+	for i, r := range c.Responses {
+		tmpl, err := template.New(fmt.Sprint("fallback", i)).Parse(r)
+		if err != nil {
+			return nil, fmt.Errorf("Fallback response %v: %w", i, err)
+		}
+		pool.responses = append(pool.responses, tmpl)
+	}
+
+	// There has to be something left to pick from
+	if pool.avoidRecent >= len(pool.responses) {
+		pool.avoidRecent = len(pool.responses) - 1
+	}
+	return pool, nil
+}
+
+func (pool *FallbackPool) Action() string {
+	return pool.action
+}
+
+// Picks a response that wasn't used recently, Twitter won't take
+// the same status twice in a row anyway. Empty if there are none.
+func (pool *FallbackPool) Choose(data FallbackData) (string, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.responses) == 0 {
+		return "", nil
+	}
+
+	candidates := []int{}
+	for i := range pool.responses {
+		used := false
+		for _, r := range pool.recent {
+			used = used || r == i
+		}
+		if !used {
+			candidates = append(candidates, i)
+		}
+	}
+
+	chosen := candidates[rand.Intn(len(candidates))]
+	pool.recent = append(pool.recent, chosen)
+	if over := len(pool.recent) - pool.avoidRecent; over > 0 {
+		pool.recent = pool.recent[over:]
+	}
+
+	var buf bytes.Buffer
+	err := pool.responses[chosen].Execute(&buf, data)
+	return buf.String(), err
+}
+
+// Decides what to post instead of a completion moderation kept
+// flagging, or post-processing left nothing of (see emptyVerdict).
+// ok is false if nothing should be posted now, because the pool
+// stays silent or the tweet was held for approval. A nil pool
+// falls back on DEFAULT_RESPONSE.
+func (pool *FallbackPool) Resolve(ctx context.Context, kind string, inReplyTo int64,
+	user User, verdict Verdict) (text string, ok bool, err error) {
+	log := logger(ctx).With("kind", kind, "user_id", user.ID, "category", verdict.Category)
+
+	if pool == nil {
+		text = DEFAULT_RESPONSE
+	} else if text, err = pool.Choose(FallbackData{User: user}); err != nil {
+		return "", false, err
+	}
+
+	// Replies have to mention the user to show up in their thread
+	if mention := "@" + user.ScreenName; inReplyTo != 0 && text != "" &&
+		!strings.Contains(text, mention) {
+		text = mention + " " + text
+	}
+
+	action := "respond"
+	if pool != nil {
+		action = pool.action
+	}
+	fallbackActions.WithLabelValues(kind, action).Inc()
+
+	switch action {
+	case "silent":
+		log.Info("Staying silent, no completion could be posted")
+		return "", false, nil
+	case "approval":
+		p := Approvals.Add(PendingTweet{
+			Kind:      kind,
+			InReplyTo: inReplyTo,
+			User:      user,
+			Suggested: text,
+			Verdict:   verdict,
+		})
+		log.Info("Holding tweet for approval, no completion could be posted",
+			"approval_id", p.ID)
+		return "", false, nil
+	}
+	log.Info("Using fallback response, no completion could be posted", "response", text)
+	return text, true, nil
+}
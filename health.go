@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fraction of JamesBuffer that can be filled before we report
+// ourselves as not ready
+var QUEUE_SATURATION_RATIO float64 = 0.8
+
+// Number of runCompletions goroutines currently running
+var completionWorkers int32
+
+// What we last heard from Twitter about the webhook and our credentials.
+// Filled in by registerWebhook and VerifyCredentials. The credentials
+// are James's own, tracked users' don't make him unready.
+var twitterStatus struct {
+	sync.Mutex
+	Webhook             *Webhook
+	WebhookCheckedAt    time.Time
+	CredentialsVerified bool
+	CredentialsErr      string
+	CredentialsAt       time.Time
+}
+
+func setWebhookStatus(w *Webhook) {
+	twitterStatus.Lock()
+	defer twitterStatus.Unlock()
+
+	twitterStatus.Webhook = w
+	twitterStatus.WebhookCheckedAt = time.Now()
+}
+
+func setCredentialsStatus(err error) {
+	twitterStatus.Lock()
+	defer twitterStatus.Unlock()
+
+	twitterStatus.CredentialsVerified = err == nil
+	twitterStatus.CredentialsErr = ""
+	if err != nil {
+		twitterStatus.CredentialsErr = err.Error()
+	}
+	twitterStatus.CredentialsAt = time.Now()
+}
+
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func checkCompletionWorkers() HealthCheck {
+	n := atomic.LoadInt32(&completionWorkers)
+	return HealthCheck{
+		OK:     n > 0,
+		Detail: fmt.Sprintf("%d completion workers running", n),
+	}
+}
+
+func checkWebhook() HealthCheck {
+	twitterStatus.Lock()
+	defer twitterStatus.Unlock()
+
+	w := twitterStatus.Webhook
+	if w == nil {
+		return HealthCheck{OK: false, Detail: "webhook not registered"}
+	}
+	return HealthCheck{
+		OK: w.Valid,
+		Detail: fmt.Sprintf("webhook %v (%v) valid=%v, checked %v",
+			w.ID, w.URL, w.Valid, twitterStatus.WebhookCheckedAt.Format(time.RFC3339)),
+	}
+}
+
+func checkCredentials() HealthCheck {
+	twitterStatus.Lock()
+	defer twitterStatus.Unlock()
+
+	if twitterStatus.CredentialsAt.IsZero() {
+		return HealthCheck{OK: false, Detail: "credentials not verified yet"}
+	}
+	if !twitterStatus.CredentialsVerified {
+		return HealthCheck{OK: false, Detail: twitterStatus.CredentialsErr}
+	}
+	return HealthCheck{
+		OK:     true,
+		Detail: "verified " + twitterStatus.CredentialsAt.Format(time.RFC3339),
+	}
+}
+
+func checkQueue() HealthCheck {
+	depth, capacity := len(JamesBuffer), cap(JamesBuffer)
+	return HealthCheck{
+		OK:     float64(depth) < float64(capacity)*QUEUE_SATURATION_RATIO,
+		Detail: fmt.Sprintf("%d/%d requests queued", depth, capacity),
+	}
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]HealthCheck) {
+	status := HealthStatus{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			status.Status = "fail"
+		}
+	}
+
+	if status.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
+
+// Liveness: the process is only useful if something is
+// consuming JamesBuffer
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]HealthCheck{
+		"completion_workers": checkCompletionWorkers(),
+	})
+}
+
+// Readiness: everything needed to actually reply to a mention
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]HealthCheck{
+		"completion_workers":  checkCompletionWorkers(),
+		"webhook":             checkWebhook(),
+		"twitter_credentials": checkCredentials(),
+		"queue":               checkQueue(),
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys whose values never make it into the logs
+var SECRET_LOG_KEYS = []string{
+	"consumer_key", "consumer_secret", "access_token", "access_token_secret",
+	"bearer_token", "api_key", "authorization", "crc_token", "response_token",
+}
+
+// Attribute keys holding tweet or completion text. These are only
+// redacted if LOG_REDACT_TEXT is set, since they're the most useful
+// thing to look at when debugging a bad reply
+var TEXT_LOG_KEYS = []string{"text", "prompt", "response"}
+
+const redacted = "[REDACTED]"
+
+// setupLogging installs the default slog logger. LOG_LEVEL is one of
+// debug, info, warn or error and LOG_FORMAT is json or text.
+func setupLogging() {
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+
+	redactText := os.Getenv("LOG_REDACT_TEXT") != ""
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			return redactAttr(a, redactText)
+		},
+	}
+
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func redactAttr(a slog.Attr, redactText bool) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, k := range SECRET_LOG_KEYS {
+		if key == k {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if redactText {
+		for _, k := range TEXT_LOG_KEYS {
+			if key == k {
+				return slog.String(a.Key, redacted)
+			}
+		}
+	}
+	return a
+}
+
+type correlationIDKey struct{}
+
+// Every webhook event (and every scheduled job) gets its own ID so
+// one mention can be followed from the webhook to the posted reply
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// Returns the default logger tagged with the correlation ID in ctx
+func logger(ctx context.Context) *slog.Logger {
+	if id := correlationID(ctx); id != "" {
+		return slog.Default().With("correlation_id", id)
+	}
+	return slog.Default()
+}
+
+// Same as logger but for a request that came through JamesBuffer
+func requestLogger(request CompletionRequest) *slog.Logger {
+	if request.CorrelationID != "" {
+		return slog.Default().With("correlation_id", request.CorrelationID)
+	}
+	return slog.Default()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,35 +16,125 @@ import (
 var JamesBuffer chan CompletionRequest = make(chan CompletionRequest, 10)
 
 func main() {
-	fmt.Println("James v0.01")
+	setupLogging()
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.Info("James v0.01")
+
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		CONFIG_PATH = path
+	}
+	config, err := loadConfig(CONFIG_PATH)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Models = config.Registry
+	if config.ReplyModel != "" {
+		REPLY_MODEL = config.ReplyModel
+	}
+	REPLY_FALLBACK_MODELS = config.ReplyFallbackModels
+	if config.ReplySampling != nil {
+		REPLY_SAMPLING = *config.ReplySampling
+	}
+	Moderation = newModerationChain(config.Moderation)
+	ReplyLimits = newReplyLimiter(config.ReplyLimits)
+	Fallbacks, err = newFallbackPool(config.Fallback)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Reranking, err = newReranker(config.Rerank)
+	if err != nil {
+		log.Fatal(err)
+	}
+	PostProcessing, err = newPostProcessChain(config.PostProcessing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if path := os.Getenv("USAGE_PATH"); path != "" {
+		USAGE_PATH = path
+	}
+	Spending, err = NewSpendingLedger(USAGE_PATH, config.Budget)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Cache != nil {
+		if path := os.Getenv("COMPLETION_CACHE_PATH"); path != "" {
+			COMPLETION_CACHE_PATH = path
+		}
+		Cache, err = NewCompletionCache(COMPLETION_CACHE_PATH, config.Cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if path := os.Getenv("SUBSCRIPTIONS_PATH"); path != "" {
+		SUBSCRIPTIONS_PATH = path
+	}
+	Subscriptions, err = NewSubscriptionStore(SUBSCRIPTIONS_PATH)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Filled in before the servers start, the webhook and the
+	// admin API read these, same as Subscriptions
+	for _, post := range config.ScheduledPosts {
+		job, err := post.job()
+		if err != nil {
+			log.Fatal(err)
+		}
+		SCHEDULED_POSTS[post.Name] = post
+		SCHEDULED_JOBS = append(SCHEDULED_JOBS, job)
+	}
+
+	Twitter, err = NewTwitterClient(context.Background(),
+		credentialsFromEnv("ACCESS_TOKEN", "ACCESS_TOKEN_SECRET"),
+		os.Getenv("BEARER_TOKEN"), ENV_NAME)
+	if err != nil {
+		log.Fatal(err)
+	}
 	routes()
-	fmt.Println("Starting server...")
+	slog.Info("Starting server...")
 
 	// Begin handling messages from the stream
 	go func() { log.Fatal(http.ListenAndServe(":8080", nil)) }()
-	go runCompletions(JamesBuffer)
+	go supervise("completions", func() error { return runCompletions(JamesBuffer) })
+	go startAdminServer()
 
-	fmt.Println("Registering Webhook")
-	registerWebhook()
+	// If this fails James keeps running, so the webhook can be
+	// registered again through the admin API once it's fixed
+	slog.Info("Registering webhook")
+	if err := registerWebhook(); err != nil {
+		slog.Error("Error registering webhook", "err", err)
+	}
 
-	// Execute horoscope function once a day at 8am PST
-	go executeHoroscope(8, 0, 0)
+	if path := os.Getenv("SCHEDULER_STATE_PATH"); path != "" {
+		SCHEDULER_STATE_PATH = path
+	}
+	scheduler, err := NewScheduler(SCHEDULER_STATE_PATH)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Runs the scheduled posts and any other jobs
+	scheduler.Start(SCHEDULED_JOBS)
 
 	// Wait for SIGING and SIGTERM (ctrl-c)
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	log.Println(<-ch)
+	slog.Info("Received signal", "signal", <-ch)
 
-	fmt.Println("Stopping server...")
+	slog.Info("Stopping server...")
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Error flushing traces", "err", err)
+	}
 }
 
 func routes() {
-	http.HandleFunc("/webhook/twitter", webhookHandler)
-}
-
-// For checking errors more easily
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
+	http.Handle("/webhook/twitter", recoverHandler(http.HandlerFunc(webhookHandler)))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 }
@@ -2,10 +2,19 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	gogpt "github.com/sashabaranov/go-gpt3"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
+	"time"
 )
 
 func TestBasicCompletion(t *testing.T) {
@@ -29,6 +38,9 @@ func TestBasicCompletion(t *testing.T) {
 }
 
 func TestSensitivity(t *testing.T) {
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		t.Skip("Needs OPENAI_API_KEY")
+	}
 	c := gogpt.NewClient(os.Getenv("OPENAI_API_KEY"))
 	ctx := context.Background()
 
@@ -43,6 +55,9 @@ func TestSensitivity(t *testing.T) {
 }
 
 func TestSensitivityRetries(t *testing.T) {
+	if os.Getenv("OPENAI_API_KEY") == "" {
+		t.Skip("Needs OPENAI_API_KEY")
+	}
 	var testResponseChan = make(chan CompletionResponse, 1)
 	dummyTempl, _ := template.New("dummy").Parse(`{{range .}}{{.Text}}{{end}}`)
 
@@ -70,13 +85,20 @@ func TestFilterDoubleResp(t *testing.T) {
 	txtJames := "James: random response "
 	txtLiam := "\nLiam: remove me"
 
-	filtered := filterResponse(txtJames + txtLiam)
+	filtered := filterResponse(txtJames+txtLiam, `\n[a-zA-z0-9]+:`)
 
 	if filtered != txtJames {
 		t.Errorf("Text did not get filtered properly. Filtered text: %v", filtered)
 	}
 }
 
+func TestFilterEmptyRegex(t *testing.T) {
+	txt := "Today's horoscope: stay in bed"
+	if filtered := filterResponse(txt, ""); filtered != txt {
+		t.Errorf("Empty regex filtered the text: %q", filtered)
+	}
+}
+
 func TestTemplateThreadFormatting(t *testing.T) {
 	lines := []Line{
 		Line{
@@ -94,7 +116,9 @@ func TestTemplateThreadFormatting(t *testing.T) {
 	}
 
 	tmpl, err := template.New("standard").Parse(`{{range .}}{{if .IsJames}}{{"James:@LiamTestAccoun3 "}}{{println .Text "\n"}}{{else}}{{"Liam:@JAMES__9000 "}}{{println .Text " \n"}}{{end}}{{end}}James:`)
-	check(err)
+	if err != nil {
+		t.Fatalf("Could not parse template, err: %v", err)
+	}
 
 	err = tmpl.Execute(os.Stdout, lines)
 
@@ -102,3 +126,1477 @@ func TestTemplateThreadFormatting(t *testing.T) {
 		t.Errorf("Did not format correctly, err: %v", err)
 	}
 }
+
+func TestParseTwitterErrorV1(t *testing.T) {
+	body := []byte(`{"errors":[{"code":187,"message":"Status is a duplicate."}]}`)
+	err := parseTwitterError("statuses_update", 403, body)
+
+	if !IsDuplicateStatus(err) {
+		t.Errorf("Duplicate status not detected, err: %v", err)
+	}
+	if IsTweetUnavailable(err) || IsExpiredToken(err) {
+		t.Errorf("Duplicate status detected as another error, err: %v", err)
+	}
+}
+
+func TestParseTwitterErrorV2(t *testing.T) {
+	body := []byte(`{"detail":"You are not allowed to create a Tweet with duplicate content.","type":"about:blank","title":"Forbidden","status":403}`)
+	err := parseTwitterError("v2_tweets_create", 403, body)
+
+	if !IsDuplicateStatus(err) {
+		t.Errorf("Duplicate status not detected, err: %v", err)
+	}
+}
+
+func TestParseTwitterErrorNotJSON(t *testing.T) {
+	err := parseTwitterError("statuses_show", 503, []byte("Service Unavailable"))
+
+	if len(err.Messages) != 1 || err.Messages[0] != "Service Unavailable" {
+		t.Errorf("Body not kept as message, err: %v", err)
+	}
+}
+
+func TestRunRecoveredPanic(t *testing.T) {
+	err := runRecovered(func() error {
+		var lines []Line
+		return errors.New(lines[1].Text)
+	})
+
+	if err == nil {
+		t.Errorf("Panic was not turned into an error")
+	}
+}
+
+func TestNextRunCatchUp(t *testing.T) {
+	job := &Job{Schedule: "0 8 * * *", TimeZone: "America/Los_Angeles", CatchUp: CatchUpOnce}
+	schedule, err := parseJobSchedule(job)
+	if err != nil {
+		t.Fatalf("Could not parse schedule: %v", err)
+	}
+
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	last := time.Date(2022, 3, 1, 8, 0, 0, 0, la)
+	now := time.Date(2022, 3, 3, 12, 0, 0, 0, la)
+
+	if next := nextRun(job, schedule, last, now); !next.Equal(now) {
+		t.Errorf("Missed run was not caught up, next: %v", next)
+	}
+
+	job.CatchUp = CatchUpSkip
+	want := time.Date(2022, 3, 4, 8, 0, 0, 0, la)
+	if next := nextRun(job, schedule, last, now); !next.Equal(want) {
+		t.Errorf("Missed run was not skipped, next: %v, want: %v", next, want)
+	}
+
+	// Never ran before, so there's nothing to catch up on
+	job.CatchUp = CatchUpOnce
+	if next := nextRun(job, schedule, time.Time{}, now); !next.Equal(want) {
+		t.Errorf("First run wrong, next: %v, want: %v", next, want)
+	}
+}
+
+func TestNextRunDuringJitter(t *testing.T) {
+	job := &Job{Schedule: "0 8 * * *", Jitter: 10 * time.Minute, CatchUp: CatchUpSkip}
+	schedule, err := parseJobSchedule(job)
+	if err != nil {
+		t.Fatalf("Could not parse schedule: %v", err)
+	}
+
+	// Restarted at 8:05, halfway through the jitter of the 8:00 run
+	last := time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)
+	due := time.Date(2022, 3, 2, 8, 0, 0, 0, time.UTC)
+	if next := nextRun(job, schedule, last, due.Add(5*time.Minute)); !next.Equal(due) {
+		t.Errorf("Run due during the jitter was skipped, next: %v, want: %v", next, due)
+	}
+
+	// Once the window is over, it was missed
+	want := time.Date(2022, 3, 3, 8, 0, 0, 0, time.UTC)
+	if next := nextRun(job, schedule, last, due.Add(time.Hour)); !next.Equal(want) {
+		t.Errorf("Missed run was not skipped, next: %v, want: %v", next, want)
+	}
+}
+
+func TestNextRunDST(t *testing.T) {
+	job := &Job{Schedule: "0 8 * * *", TimeZone: "America/Los_Angeles", CatchUp: CatchUpSkip}
+	schedule, err := parseJobSchedule(job)
+	if err != nil {
+		t.Fatalf("Could not parse schedule: %v", err)
+	}
+
+	// Clocks go forward on March 13th 2022, it should still be 8am local
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	last := time.Date(2022, 3, 12, 8, 0, 0, 0, la)
+	next := nextRun(job, schedule, last, last.Add(time.Minute))
+
+	if next.In(la).Hour() != 8 || next.Sub(last) != 23*time.Hour {
+		t.Errorf("DST not handled, next: %v", next)
+	}
+}
+
+func TestParseJobScheduleBadZone(t *testing.T) {
+	_, err := parseJobSchedule(&Job{Schedule: "0 8 * * *", TimeZone: "Mars/Olympus_Mons"})
+	if err == nil {
+		t.Errorf("Unknown time zone was accepted")
+	}
+}
+
+func TestLoadConfigScheduledPosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"scheduled_posts": [{
+		"name": "myth",
+		"schedule": "0 9 * * *",
+		"jitter": "10m",
+		"template": "Tell a myth about {{.Date.Format \"January 2\"}} for @{{.User.ScreenName}}:",
+		"model": "davinci",
+		"target": "dm",
+		"users": ["someone"]
+	}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %v", err)
+	}
+	if len(loaded.ScheduledPosts) != 1 {
+		t.Fatalf("Expected 1 scheduled post, got %v", len(loaded.ScheduledPosts))
+	}
+
+	post := loaded.ScheduledPosts[0]
+	if post.Model != Davinci || post.Jitter != Duration(10*time.Minute) || post.CatchUp != CatchUpSkip {
+		t.Errorf("Post not parsed right: %+v", post)
+	}
+
+	prompt, err := post.prompt(PostData{
+		User: User{ScreenName: "someone"},
+		Date: time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC),
+	})
+	if err != nil || prompt != "Tell a myth about March 1 for @someone:" {
+		t.Errorf("Template rendered wrong: %q, err: %v", prompt, err)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	loaded, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("Missing config should not be an error: %v", err)
+	}
+	if len(loaded.ScheduledPosts) != 1 || loaded.ScheduledPosts[0].Name != "horoscope" {
+		t.Errorf("Expected the default horoscope, got %+v", loaded.ScheduledPosts)
+	}
+
+	prompt, err := loaded.ScheduledPosts[0].prompt(PostData{User: User{ScreenName: "liamport9"}})
+	if err != nil || !strings.HasSuffix(prompt, "4.@liamport9 ") {
+		t.Errorf("Horoscope prompt rendered wrong: %q, err: %v", prompt, err)
+	}
+}
+
+func TestScheduledPostValidation(t *testing.T) {
+	bad := []ScheduledPost{
+		{Name: "no_users", Model: "davinci", Target: TargetReply},
+		{Name: "bad_target", Model: "davinci", Target: "fax"},
+		{Name: "bad_model", Model: "gpt-9", Target: TargetTimeline},
+		{Name: "bad_template", Model: "davinci", Target: TargetTimeline, Template: "{{.User"},
+	}
+	for _, post := range bad {
+		if err := post.compile(Models); err == nil {
+			t.Errorf("Post %v should not be valid", post.Name)
+		}
+	}
+}
+
+func TestParseSubscriptionCommand(t *testing.T) {
+	SCHEDULED_POSTS["horoscope"] = &ScheduledPost{Name: "horoscope", Subscribers: "horoscope"}
+	defer delete(SCHEDULED_POSTS, "horoscope")
+
+	cmd, ok := parseSubscriptionCommand("@JAMES__9000 Subscribe horoscope LEO dm please")
+	if !ok || !cmd.Subscribe || cmd.Topic != "horoscope" || cmd.Sign != "Leo" || !cmd.DM {
+		t.Errorf("Subscribe command parsed wrong: %+v, ok: %v", cmd, ok)
+	}
+
+	cmd, ok = parseSubscriptionCommand("@JAMES__9000 unsubscribe horoscope")
+	if !ok || cmd.Subscribe || cmd.Topic != "horoscope" {
+		t.Errorf("Unsubscribe command parsed wrong: %+v, ok: %v", cmd, ok)
+	}
+
+	if _, ok := parseSubscriptionCommand("@JAMES__9000 subscribe newsletter"); ok {
+		t.Errorf("Unknown topic was accepted")
+	}
+	if _, ok := parseSubscriptionCommand("@JAMES__9000 what's my horoscope?"); ok {
+		t.Errorf("Normal mention taken as a command")
+	}
+}
+
+func TestSubscriptionConfirmationsAreLimited(t *testing.T) {
+	updates := 0
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1.1/statuses/update.json" {
+			updates++
+		}
+		w.Write([]byte(`{"id":1}`))
+	})
+
+	store, err := NewSubscriptionStore(filepath.Join(t.TempDir(), "subscriptions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(client *TwitterClient, subs *SubscriptionStore, limiter *ReplyLimiter) {
+		Twitter, Subscriptions, ReplyLimits = client, subs, limiter
+	}(Twitter, Subscriptions, ReplyLimits)
+	Twitter, Subscriptions = tc, store
+	ReplyLimits = newReplyLimiter(&ReplyLimitsConfig{User: BucketConfig{Burst: 2, Every: Duration(time.Hour)}})
+
+	user := User{ID: 9, ScreenName: "flipper"}
+	for i := 0; i < 5; i++ {
+		cmd := SubscriptionCommand{Subscribe: i%2 == 0, Topic: "horoscope"}
+		if err := handleSubscriptionCommand(context.Background(), Tweet{ID: int64(100 + i), User: user}, cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if updates != 2 {
+		t.Errorf("Posted %v confirmations with a burst of 2", updates)
+	}
+	if subs := store.List("horoscope"); len(subs) != 1 || subs[0].User.ID != 9 {
+		t.Errorf("Subscription not changed without a confirmation: %+v", subs)
+	}
+}
+
+func TestSubscriptionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.json")
+	store, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	store.Subscribe("horoscope", Subscription{User: User{ID: 1}, Since: start})
+	store.Subscribe("horoscope", Subscription{User: User{ID: 2}, Since: start.Add(time.Hour)})
+	store.MarkSent("horoscope", 1, start.Add(24*time.Hour))
+
+	// Resubscribing to change the sign keeps when they were last sent one
+	store.Subscribe("horoscope", Subscription{User: User{ID: 1}, Sign: "Leo"})
+
+	reloaded, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatalf("Could not reload subscriptions: %v", err)
+	}
+	subs := reloaded.List("horoscope")
+	if len(subs) != 2 || subs[0].User.ID != 2 || subs[1].Sign != "Leo" || subs[1].LastSent.IsZero() {
+		t.Errorf("Subscriptions not kept right: %+v", subs)
+	}
+
+	if existed, _ := reloaded.Unsubscribe("horoscope", 2); !existed || len(reloaded.List("horoscope")) != 1 {
+		t.Errorf("Unsubscribe did not remove the subscription")
+	}
+}
+
+func TestModerationRules(t *testing.T) {
+	config := &ModerationConfig{
+		Moderators: []string{"rules"},
+		Rules: []*ModerationRule{
+			{Category: "spam", Words: []string{"giveaway", "c.o.i.n"}},
+			{Category: "links", Pattern: `https?://`},
+		},
+	}
+	if err := config.compile(); err != nil {
+		t.Fatalf("Could not compile rules: %v", err)
+	}
+	chain := newModerationChain(config)
+
+	verdict, err := chain.Check(context.Background(), "input", "Huge GIVEAWAY today")
+	if err != nil || !verdict.Flagged || verdict.Category != "spam" || verdict.Moderator != "rules" {
+		t.Errorf("Spam not flagged: %+v, err: %v", verdict, err)
+	}
+
+	// Words are matched whole, and the dots are literal
+	verdict, err = chain.Check(context.Background(), "input", "giveaways of coins")
+	if err != nil || verdict.Flagged {
+		t.Errorf("Clean text flagged: %+v, err: %v", verdict, err)
+	}
+}
+
+func TestModerationThresholds(t *testing.T) {
+	chain := &ModerationChain{thresholds: map[string]float64{"default": 0.5, "violence": 0.9}}
+
+	if _, _, flagged := chain.worst(map[string]float64{"violence": 0.8, "hate": 0.1}); flagged {
+		t.Errorf("Violence under its own threshold was flagged")
+	}
+	category, _, flagged := chain.worst(map[string]float64{"violence": 0.95, "hate": 0.52})
+	if !flagged || category != "violence" {
+		t.Errorf("Expected violence to be flagged, got %q, flagged: %v", category, flagged)
+	}
+}
+
+func TestContentFilterOnlyFlagsUnsafe(t *testing.T) {
+	chain := newModerationChain(DEFAULT_MODERATION)
+	if _, _, flagged := chain.worst(map[string]float64{"unsafe": contentFilterScore(1)}); flagged {
+		t.Error("Sensitive text flagged with the default thresholds")
+	}
+	if _, _, flagged := chain.worst(map[string]float64{"unsafe": contentFilterScore(2)}); !flagged {
+		t.Error("Unsafe text not flagged")
+	}
+
+	strict := &ModerationChain{thresholds: map[string]float64{"unsafe": 0.2}}
+	if _, _, flagged := strict.worst(map[string]float64{"unsafe": contentFilterScore(1)}); !flagged {
+		t.Error("Sensitive text not flagged with a lowered threshold")
+	}
+}
+
+func TestOpenAIModerator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"flagged":true,"categories":{"harassment":true,"hate":false},` +
+			`"category_scores":{"harassment":0.91,"hate":0.02}}]}`))
+	}))
+	defer server.Close()
+
+	defer func(url string) { OPENAI_MODERATION_URL = url }(OPENAI_MODERATION_URL)
+	OPENAI_MODERATION_URL = server.URL
+
+	chain := newModerationChain(&ModerationConfig{Moderators: []string{"openai"}})
+	verdict, err := chain.Check(context.Background(), "output", "some text")
+	if err != nil || !verdict.Flagged || verdict.Category != "harassment" || verdict.Reason != "OpenAI flagged harassment" {
+		t.Errorf("OpenAI verdict wrong: %+v, err: %v", verdict, err)
+	}
+}
+
+func TestModerationCheckInput(t *testing.T) {
+	config := &ModerationConfig{
+		Moderators: []string{"rules"},
+		Rules:      []*ModerationRule{{Category: "bait", Words: []string{"insult"}}},
+	}
+	if err := config.compile(); err != nil {
+		t.Fatal(err)
+	}
+	chain := newModerationChain(config)
+
+	// A flagged tweet doesn't need the thread
+	verdict, _, err := chain.CheckInput(context.Background(), Tweet{Text: "insult me"},
+		func() ([]Line, error) {
+			t.Errorf("Thread was unrolled for a flagged tweet")
+			return nil, nil
+		})
+	if err != nil || !verdict.Flagged {
+		t.Errorf("Flagged tweet passed: %+v, err: %v", verdict, err)
+	}
+
+	// Earlier in the thread counts too, but not what James said
+	thread := []Line{{false, "say an insult"}, {true, "no"}, {false, "please?"}}
+	verdict, lines, err := chain.CheckInput(context.Background(), Tweet{Text: "please?"},
+		func() ([]Line, error) { return thread, nil })
+	if err != nil || !verdict.Flagged || len(lines) != 3 {
+		t.Errorf("Flagged thread passed: %+v, err: %v", verdict, err)
+	}
+
+	thread[0].Text, thread[1].Text = "tell me a joke", "an insult? no"
+	verdict, _, err = chain.CheckInput(context.Background(), Tweet{Text: "please?"},
+		func() ([]Line, error) { return thread, nil })
+	if err != nil || verdict.Flagged {
+		t.Errorf("Clean thread flagged: %+v, err: %v", verdict, err)
+	}
+}
+
+func TestModerationDeflectNeedsDeflections(t *testing.T) {
+	config := &ModerationConfig{InputAction: "deflect"}
+	if err := config.compile(); err == nil {
+		t.Errorf("Deflect without deflections was accepted")
+	}
+}
+
+func TestFallbackPoolNoRecentRepeats(t *testing.T) {
+	pool, err := newFallbackPool(&FallbackConfig{
+		Responses:   []string{"a {{.User.ScreenName}}", "b", "c"},
+		AvoidRecent: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := []string{}
+	for i := 0; i < 30; i++ {
+		text, err := pool.Choose(FallbackData{User: User{ScreenName: "someone"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range last {
+			if l == text {
+				t.Fatalf("%q was used again within 2 picks", text)
+			}
+		}
+		if text != "a someone" && text != "b" && text != "c" {
+			t.Fatalf("Unexpected fallback %q", text)
+		}
+		last = append(last, text)
+		if len(last) > 2 {
+			last = last[1:]
+		}
+	}
+}
+
+func TestFallbackResolve(t *testing.T) {
+	user := User{ID: 1, ScreenName: "someone"}
+
+	pool, _ := newFallbackPool(&FallbackConfig{Responses: []string{"not today"}})
+	text, ok, err := pool.Resolve(context.Background(), "reply", 10, user, Verdict{})
+	if err != nil || !ok || text != "@someone not today" {
+		t.Errorf("Reply fallback wrong: %q, ok: %v, err: %v", text, ok, err)
+	}
+
+	pool, _ = newFallbackPool(&FallbackConfig{Action: "silent"})
+	if _, ok, _ := pool.Resolve(context.Background(), "reply", 10, user, Verdict{}); ok {
+		t.Errorf("Silent fallback wanted to post")
+	}
+
+	pool, _ = newFallbackPool(&FallbackConfig{Action: "approval", Responses: []string{"hmm"}})
+	if _, ok, _ := pool.Resolve(context.Background(), "reply", 10, user, Verdict{Flagged: true}); ok {
+		t.Errorf("Approval fallback wanted to post right away")
+	}
+	pending := Approvals.List()
+	if len(pending) == 0 || pending[len(pending)-1].Suggested != "@someone hmm" {
+		t.Fatalf("Tweet not held for approval: %+v", pending)
+	}
+	if _, ok := Approvals.Take(pending[len(pending)-1].ID); !ok {
+		t.Errorf("Could not take pending tweet off the queue")
+	}
+}
+
+func TestBuildPromptChat(t *testing.T) {
+	model, _ := Models.Get(GPT4oMini)
+	request := CompletionRequest{
+		Lines:    []Line{{false, "hi James"}, {true, "hello"}, {false, "tell me a joke"}},
+		Template: *StandardTmpl,
+		System:   "You are James",
+	}
+
+	prompt, messages, err := buildPrompt(model, request)
+	if err != nil || prompt != "" || len(messages) != 4 {
+		t.Fatalf("Chat prompt built wrong: %q, %+v, err: %v", prompt, messages, err)
+	}
+	if messages[0].Role != "system" || messages[2].Role != "assistant" || messages[3].Content != "tell me a joke" {
+		t.Errorf("Messages have the wrong roles: %+v", messages)
+	}
+}
+
+func TestBuildPromptTrimsToContext(t *testing.T) {
+	model := &Model{Name: "tiny", Style: StyleCompletion, ContextLength: 50}
+	long := strings.Repeat("word ", 60)
+	request := CompletionRequest{
+		Lines:  []Line{{false, long}, {true, "ok"}, {false, "and now?"}},
+		Tokens: 10,
+	}
+	tmpl, _ := template.New("lines").Parse(`{{range .}}{{.Text}}
+{{end}}`)
+	request.Template = *tmpl
+
+	prompt, _, err := buildPrompt(model, request)
+	if err != nil || strings.Contains(prompt, "word") || !strings.Contains(prompt, "and now?") {
+		t.Errorf("Oldest line was not dropped: %q, err: %v", prompt, err)
+	}
+}
+
+func TestChatCompletion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := chatRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != GPT4oMini || len(req.Messages) != 2 {
+			t.Errorf("Unexpected chat request: %+v", req)
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Why not?"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool) {
+		OPENAI_CHAT_URL, STREAM_COMPLETIONS = url, stream
+	}(OPENAI_CHAT_URL, STREAM_COMPLETIONS)
+	OPENAI_CHAT_URL, STREAM_COMPLETIONS = server.URL, false
+
+	model, _ := Models.Get(GPT4oMini)
+	candidates, usage, err := callModel(context.Background(), nil, model, CompletionRequest{},
+		"", chatMessages("You are James", []Line{{false, "why?"}}))
+	if err != nil || len(candidates) != 1 || candidates[0].Text != "Why not?" ||
+		usage.PromptTokens != 12 || usage.CompletionTokens != 3 {
+		t.Errorf("Chat completion wrong: %+v, %+v, err: %v", candidates, usage, err)
+	}
+}
+
+func TestStreamCutter(t *testing.T) {
+	cutter, _ := newStreamCutter(`\n[a-zA-z0-9]+:`, []string{"<end>"})
+
+	for _, chunk := range []string{"@Liam Sure", ", here's one\nLi"} {
+		if cutter.Write(chunk) {
+			t.Fatalf("Cut before the filter matched, at %q", chunk)
+		}
+	}
+	if !cutter.Write("am: thanks") || cutter.Text() != "@Liam Sure, here's one" {
+		t.Errorf("Filter match split over chunks not cut: %q", cutter.Text())
+	}
+
+	cutter, _ = newStreamCutter("", []string{"<end>"})
+	if !cutter.Write("done<end>more") || cutter.Text() != "done" {
+		t.Errorf("Stop sequence not cut: %q", cutter.Text())
+	}
+}
+
+func TestStreamCompletionCutEarly(t *testing.T) {
+	sent := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := completionStreamRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream || len(req.Stop) != 1 {
+			t.Errorf("Unexpected streaming request: %+v", req)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, text := range []string{"Beware", " of beagles", "\nLiam:", " what?", " more"} {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"choices": []map[string]string{{"text": text}},
+			})
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			sent++
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	defer func(url string) { OPENAI_COMPLETIONS_URL = url }(OPENAI_COMPLETIONS_URL)
+	OPENAI_COMPLETIONS_URL = server.URL
+
+	model, _ := Models.Get(GPT35TurboInstruct)
+	request := CompletionRequest{FilterRegex: `\n[a-zA-z0-9]+:`, Stop: []string{"\nLiam:"}, Tokens: 50}
+	candidates, usage, err := streamModel(context.Background(), model, request, "Tell me my horoscope", nil)
+	if err != nil || len(candidates) != 1 || candidates[0].Text != "Beware of beagles" {
+		t.Errorf("Stream not cut at the filter: %+v, err: %v", candidates, err)
+	}
+	if usage.PromptTokens == 0 || usage.CompletionTokens == 0 {
+		t.Errorf("Usage of a cut stream was not estimated: %+v", usage)
+	}
+}
+
+func TestRerankScorers(t *testing.T) {
+	reranker, err := newReranker(&RerankConfig{
+		Candidates: 3,
+		Scorers:    map[string]float64{"length": 1, "repetition": 1, "duplicate": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := RerankContext{
+		Lines: []Line{
+			{false, "@JAMES__9000 what should I read?"},
+			{true, "@LiamTestAccoun3 Try a book about beagles, they are lovely dogs"},
+			{false, "@JAMES__9000 anything else?"},
+		},
+		Recent: []string{"@someone Never trust a carrot thrown through your window"},
+	}
+	ranked := reranker.Rank([]Candidate{
+		{Text: "@LiamTestAccoun3 Ok"},
+		{Text: "@LiamTestAccoun3 Try a book about beagles, they are lovely dogs!"},
+		{Text: "@LiamTestAccoun3 Never trust a carrot thrown through your window"},
+		{Text: "@LiamTestAccoun3 The Odyssey, if you're into long trips that go wrong"},
+	}, rc)
+
+	if !strings.Contains(ranked[0].Text, "Odyssey") {
+		t.Errorf("Wrong candidate ranked first: %+v", ranked)
+	}
+	for _, r := range ranked {
+		switch {
+		case strings.Contains(r.Text, "beagles") && r.Scores["repetition"] > 0.5,
+			strings.Contains(r.Text, "carrot") && r.Scores["duplicate"] != 0,
+			strings.HasSuffix(r.Text, "Ok") && r.Scores["length"] >= 1:
+			t.Errorf("Candidate not penalized: %+v", r)
+		}
+	}
+
+	if _, err := newReranker(&RerankConfig{Scorers: map[string]float64{"vibes": 1}}); err == nil {
+		t.Error("Unknown scorer accepted")
+	}
+}
+
+func TestRerankLogProbs(t *testing.T) {
+	reranker, _ := newReranker(&RerankConfig{Scorers: map[string]float64{"logprob": 1}})
+	if !reranker.UsesLogProbs() || reranker.Candidates() != 1 {
+		t.Errorf("Reranker config not applied: %+v", reranker)
+	}
+
+	ranked := reranker.Rank([]Candidate{
+		{Text: "unsure", LogProb: meanLogProb([]float64{-2, -3})},
+		{Text: "sure", LogProb: meanLogProb([]float64{-0.1, -0.2})},
+		{Text: "unknown"},
+	}, RerankContext{})
+	if ranked[0].Text != "sure" || ranked[2].Text != "unknown" {
+		t.Errorf("Candidates not ranked by log probability: %+v", ranked)
+	}
+}
+
+func TestCompleteDropsFlaggedCandidates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := chatRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.N != 3 {
+			t.Errorf("Asked for %v candidates instead of 3", req.N)
+		}
+		w.Write([]byte(`{"choices":[` +
+			`{"index":0,"message":{"role":"assistant","content":"@Liam Go buy some crypto, it's the best thing to read about"}},` +
+			`{"index":1,"message":{"role":"assistant","content":"@Liam Ok"}},` +
+			`{"index":2,"message":{"role":"assistant","content":"@Liam Read Dune, then read it again"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":30}}`))
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool, chain *ModerationChain, reranker *Reranker) {
+		OPENAI_CHAT_URL, STREAM_COMPLETIONS, Moderation, Reranking = url, stream, chain, reranker
+	}(OPENAI_CHAT_URL, STREAM_COMPLETIONS, Moderation, Reranking)
+	OPENAI_CHAT_URL, STREAM_COMPLETIONS = server.URL, false
+
+	config := &ModerationConfig{
+		Moderators: []string{"rules"},
+		Rules:      []*ModerationRule{{Category: "spam", Words: []string{"crypto"}}},
+	}
+	if err := config.compile(); err != nil {
+		t.Fatal(err)
+	}
+	Moderation = newModerationChain(config)
+	Reranking, _ = newReranker(&RerankConfig{Candidates: 3, Scorers: map[string]float64{"length": 1}})
+
+	text, _, verdict, err := complete(context.Background(), nil, CompletionRequest{
+		Prompt:      "what should I read?",
+		Model:       GPT4oMini,
+		FilterRegex: `\n[a-zA-z0-9]+:`,
+	})
+	if err != nil || text != "@Liam Read Dune, then read it again" || verdict.Flagged {
+		t.Errorf("Wrong candidate picked: %q, %+v, err: %v", text, verdict, err)
+	}
+}
+
+func TestCompletionCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	config := &CacheConfig{TTL: Duration(time.Hour), MaxEntries: 2}
+	cache, err := NewCompletionCache(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cache.Put("a", GPT4oMini, []Candidate{{Text: "joke a"}}, now)
+	cache.Put("b", GPT4oMini, []Candidate{{Text: "joke b"}}, now.Add(time.Minute))
+	if got, ok := cache.Get("a", now.Add(2*time.Minute)); !ok || got[0].Text != "joke a" {
+		t.Errorf("Cached completion not found: %+v", got)
+	}
+
+	// "b" is the least recently used now
+	cache.Put("c", GPT4oMini, []Candidate{{Text: "joke c"}}, now.Add(3*time.Minute))
+	if _, ok := cache.Get("b", now.Add(3*time.Minute)); ok || cache.Len() != 2 {
+		t.Errorf("Least recently used entry not evicted, %v entries", cache.Len())
+	}
+	if _, ok := cache.Get("c", now.Add(2*time.Hour)); ok {
+		t.Error("Expired entry returned")
+	}
+
+	reloaded, err := NewCompletionCache(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Get("a", now.Add(5*time.Minute)); !ok || got[0].Text != "joke a" {
+		t.Errorf("Cache not persisted: %+v", got)
+	}
+}
+
+func TestCompletionCacheEnabled(t *testing.T) {
+	cache, _ := NewCompletionCache(filepath.Join(t.TempDir(), "cache.json"), &CacheConfig{
+		TTL:        Duration(time.Hour),
+		MaxEntries: 10,
+		Templates:  map[string]bool{"standard": true, "facts": false},
+	})
+	if !cache.Enabled("standard", 0.9) || cache.Enabled("facts", 0) ||
+		cache.Enabled("horoscope", 0.8) || !cache.Enabled("horoscope", 0.2) {
+		t.Error("Per template cache settings not applied")
+	}
+	if (*CompletionCache)(nil).Enabled("standard", 0) {
+		t.Error("Nil cache is enabled")
+	}
+	if _, err := NewCompletionCache("", &CacheConfig{MaxEntries: 10}); err == nil {
+		t.Error("Cache without a ttl accepted")
+	}
+}
+
+func TestCompleteUsesCache(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Knock knock"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool, cache *CompletionCache) {
+		OPENAI_CHAT_URL, STREAM_COMPLETIONS, Cache = url, stream, cache
+	}(OPENAI_CHAT_URL, STREAM_COMPLETIONS, Cache)
+	OPENAI_CHAT_URL, STREAM_COMPLETIONS = server.URL, false
+	Cache, _ = NewCompletionCache(filepath.Join(t.TempDir(), "cache.json"),
+		&CacheConfig{TTL: Duration(time.Hour), MaxEntries: 10})
+
+	for _, temperature := range []float32{0.2, 0.2, 0.9} {
+		text, _, _, err := complete(context.Background(), nil, CompletionRequest{
+			Prompt:       "tell me a joke",
+			TemplateName: "joke",
+			Model:        GPT4oMini,
+			Temperature:  temperature,
+			FilterRegex:  `\n[a-zA-z0-9]+:`,
+		})
+		if err != nil || text != "Knock knock" {
+			t.Errorf("Wrong completion: %q, err: %v", text, err)
+		}
+	}
+	if calls != 2 || Cache.Len() != 1 {
+		t.Errorf("Expected 2 API calls and 1 cached completion, got %v and %v", calls, Cache.Len())
+	}
+}
+
+func TestSpendingLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	ledger, err := NewSpendingLedger(path, &BudgetConfig{Daily: 1, UserDaily: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// $0.06 per 1K tokens, so 5K tokens are $0.30
+	model, _ := Models.Get(Davinci)
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	ledger.Record(now, model, "standard", 42, Usage{4000, 1000})
+	ledger.Record(now, model, "horoscope", 7, Usage{4000, 1000})
+
+	report := ledger.Report(now)
+	day := report.Days[0]
+	if report.Today.Requests != 2 || report.Today.PromptTokens != 8000 ||
+		day.Users[42].CompletionTokens != 1000 || day.Templates["horoscope"].Requests != 1 ||
+		day.Models[Davinci].Requests != 2 {
+		t.Errorf("Usage not aggregated: %+v", report)
+	}
+
+	if _, err := ledger.Plan(now, model, 42); err != nil {
+		t.Errorf("Under budget request refused: %v", err)
+	}
+	ledger.Record(now, model, "standard", 42, Usage{4000, 1000})
+	if _, err := ledger.Plan(now, model, 42); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("User over their budget not refused: %v", err)
+	}
+	if _, err := ledger.Plan(now, model, 7); err != nil || ledger.OverBudget(now) {
+		t.Errorf("Other users refused with $%.2f spent: %v", ledger.Report(now).Today.Cost, err)
+	}
+
+	ledger.Record(now, model, "horoscope", 7, Usage{4000, 1000})
+	if !ledger.OverBudget(now) || ledger.OverBudget(now.AddDate(0, 0, 1)) {
+		t.Error("Daily budget not enforced for just today")
+	}
+
+	reloaded, err := NewSpendingLedger(path, nil)
+	if err != nil || reloaded.Report(now).Today.Requests != 4 {
+		t.Errorf("Usage not persisted, err: %v", err)
+	}
+}
+
+func TestSpendingLedgerDegrades(t *testing.T) {
+	ledger, _ := NewSpendingLedger(filepath.Join(t.TempDir(), "usage.json"), &BudgetConfig{
+		Monthly:      10,
+		DegradeAt:    0.5,
+		DegradeModel: GPT4oMini,
+	})
+
+	davinci, _ := Models.Get(Davinci)
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	if m, _ := ledger.Plan(now, davinci, 0); m != davinci {
+		t.Errorf("Degraded to %v before reaching degrade_at", m.Name)
+	}
+
+	// $6 earlier in the month
+	ledger.Record(now.AddDate(0, 0, -3), davinci, "standard", 0, Usage{100000, 0})
+	if m, _ := ledger.Plan(now, davinci, 0); m.Name != GPT4oMini {
+		t.Errorf("Not degraded to the cheaper model: %v", m.Name)
+	}
+	cheap := &Model{Name: "free", Style: StyleChat, ContextLength: 4096, BaseURL: "http://localhost:11434/v1"}
+	if m, _ := ledger.Plan(now, cheap, 0); m != cheap {
+		t.Errorf("Degraded to a more expensive model: %v", m.Name)
+	}
+	if m, _ := ledger.Plan(now.AddDate(0, 1, 0), davinci, 0); m != davinci {
+		t.Error("Last month's spending still degrades")
+	}
+}
+
+func TestOnlyLocalModelsAreFree(t *testing.T) {
+	unpriced := &Model{Name: "gpt-4o", Style: StyleChat, ContextLength: 128000}
+	if _, err := newModelRegistry([]*Model{unpriced}); err == nil {
+		t.Error("OpenAI model without prices accepted")
+	}
+
+	local := &Model{Name: "local", Style: StyleChat, ContextLength: 8192, BaseURL: "http://localhost:11434/v1"}
+	hosted := &Model{Name: "hosted", Style: StyleChat, ContextLength: 8192, BaseURL: "https://api.example.com/v1",
+		PromptPrice: 0.001, CompletionPrice: 0.002}
+	if _, err := newModelRegistry([]*Model{local, hosted}); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, _ := NewSpendingLedger(filepath.Join(t.TempDir(), "usage.json"), &BudgetConfig{Daily: 1})
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	ledger.Record(now, hosted, "standard", 0, Usage{1000000, 0})
+	if _, err := ledger.Plan(now, local, 0); err != nil {
+		t.Errorf("Local model refused over budget: %v", err)
+	}
+	if _, err := ledger.Plan(now, hosted, 0); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("Priced model not refused over budget: %v", err)
+	}
+	if _, err := ledger.Plan(now, unpriced, 0); !errors.Is(err, ErrOverBudget) {
+		t.Errorf("Unpriced OpenAI model skipped the budget: %v", err)
+	}
+}
+
+func TestAnyFreeModel(t *testing.T) {
+	registry, err := newModelRegistry([]*Model{
+		{Name: "local", Style: StyleChat, ContextLength: 8192, BaseURL: "http://localhost:11434/v1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.AnyFree([]string{GPT4oMini, GPT35Turbo}) {
+		t.Error("OpenAI models taken as free")
+	}
+	if !registry.AnyFree([]string{GPT4oMini, "local"}) {
+		t.Error("Local fallback model not found")
+	}
+}
+
+func TestReplyLimitsQuotas(t *testing.T) {
+	limiter := newReplyLimiter(&ReplyLimitsConfig{
+		User:   BucketConfig{Burst: 2, Every: Duration(time.Minute)},
+		Global: BucketConfig{Burst: 3, Every: Duration(time.Hour)},
+	})
+
+	now := time.Now()
+	for i, want := range []string{"", "", "user_quota"} {
+		if reason, _ := limiter.Allow(1, now); reason != want {
+			t.Errorf("Reply %v to user 1: got %q, want %q", i, reason, want)
+		}
+	}
+	if reason, ok := limiter.Allow(1, now.Add(time.Minute)); !ok {
+		t.Errorf("User bucket not refilled after a minute: %q", reason)
+	}
+	if reason, _ := limiter.Allow(2, now.Add(time.Minute)); reason != "global_quota" {
+		t.Errorf("Global quota not enforced: %q", reason)
+	}
+}
+
+func TestReplyLimitsLoopDetection(t *testing.T) {
+	limiter := newReplyLimiter(&ReplyLimitsConfig{
+		LoopReplies: 3,
+		LoopWindow:  Duration(10 * time.Second),
+		LoopMute:    Duration(time.Hour),
+	})
+
+	// A human taking their time never trips it
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		if reason, ok := limiter.Allow(1, now); !ok {
+			t.Fatalf("Slow user limited: %q", reason)
+		}
+		limiter.Replied(1, 100, now)
+	}
+
+	// A bot answering every reply right away does
+	muted := false
+	for i := 0; i < 4 && !muted; i++ {
+		now = now.Add(2 * time.Second)
+		reason, ok := limiter.Allow(2, now)
+		muted = reason == "reply_loop"
+		if ok {
+			limiter.Replied(2, 200, now)
+		}
+	}
+	if !muted {
+		t.Fatal("Reply loop not detected")
+	}
+	if _, ok := limiter.Allow(2, now.Add(30*time.Minute)); ok {
+		t.Error("Bot unmuted before loop_mute")
+	}
+	if _, ok := limiter.Allow(2, now.Add(2*time.Hour)); !ok {
+		t.Error("Bot still muted after loop_mute")
+	}
+}
+
+func TestReplyLimitsThreads(t *testing.T) {
+	limiter := newReplyLimiter(&ReplyLimitsConfig{
+		ThreadCooldown: Duration(time.Minute),
+		MaxThreadDepth: 10,
+	})
+
+	now := time.Now()
+	if reason, _ := limiter.AllowThread(100, 11, now); reason != "thread_depth" {
+		t.Errorf("Max thread depth not enforced: %q", reason)
+	}
+	limiter.Replied(1, 100, now)
+	if reason, _ := limiter.AllowThread(100, 3, now.Add(30*time.Second)); reason != "thread_cooldown" {
+		t.Errorf("Thread cooldown not enforced: %q", reason)
+	}
+	if _, ok := limiter.AllowThread(200, 3, now.Add(30*time.Second)); !ok {
+		t.Error("Cooldown applied to another thread")
+	}
+	if _, ok := limiter.AllowThread(100, 3, now.Add(2*time.Minute)); !ok {
+		t.Error("Thread still cooling down")
+	}
+}
+
+func TestCompleteFallsBackToNextModel(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":{"message":"overloaded","type":"server_error"}}`))
+	}))
+	defer primary.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(300 * time.Millisecond):
+		}
+	}))
+	defer slow.Close()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "" {
+			t.Errorf("Unexpected request to local model: %v, auth %q",
+				r.URL.Path, r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Local hello"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+	}))
+	defer local.Close()
+
+	defer func(models *ModelRegistry, stream bool) {
+		Models, STREAM_COMPLETIONS = models, stream
+	}(Models, STREAM_COMPLETIONS)
+	STREAM_COMPLETIONS = false
+	Models = mustModelRegistry([]*Model{
+		{Name: "primary", Style: StyleChat, ContextLength: 4096, BaseURL: primary.URL, APIKeyEnv: "PRIMARY_KEY"},
+		{Name: "slow", Style: StyleChat, ContextLength: 4096, BaseURL: slow.URL,
+			Timeout: Duration(50 * time.Millisecond)},
+		{Name: "local", ID: "llama3", Style: StyleChat, ContextLength: 4096, BaseURL: local.URL + "/v1/"},
+	})
+
+	text, model, _, err := complete(context.Background(), nil, CompletionRequest{
+		Prompt:         "hi",
+		Model:          "primary",
+		FallbackModels: []string{"slow", "local"},
+		FilterRegex:    `\n[a-zA-z0-9]+:`,
+	})
+	if err != nil || text != "Local hello" || model != "local" {
+		t.Errorf("Did not fall back to the local model: %q from %q, err: %v", text, model, err)
+	}
+
+	_, _, _, err = complete(context.Background(), nil, CompletionRequest{
+		Prompt:      "hi",
+		Model:       "primary",
+		FilterRegex: `\n[a-zA-z0-9]+:`,
+	})
+	var modelErr *ModelError
+	if !errors.As(err, &modelErr) || modelErr.Model != "primary" {
+		t.Errorf("Expected the primary model's error without fallbacks, got %v", err)
+	}
+}
+
+func TestPromptSpeakers(t *testing.T) {
+	var buf strings.Builder
+	StandardTmpl.Execute(&buf, []Line{{false, "hey"}, {true, "hi"}, {false, "joke?"}})
+
+	speakers := promptSpeakers(buf.String())
+	if len(speakers) != 2 || speakers[0] != "Liam" || speakers[1] != "James" {
+		t.Errorf("Wrong speakers found: %v", speakers)
+	}
+	if stops := speakerStops(speakers); stops[0] != "\nLiam:" || stops[1] != "\nJames:" {
+		t.Errorf("Wrong stops: %q", stops)
+	}
+	if speakers := promptSpeakers(HoroscopeTmpl); len(speakers) != 0 {
+		t.Errorf("Found speakers in a prompt without any: %v", speakers)
+	}
+}
+
+func TestSamplingValidation(t *testing.T) {
+	for _, s := range []Sampling{
+		{Temperature: 3},
+		{TopP: 1.5},
+		{PresencePenalty: -3},
+		{BestOf: -1},
+		{LogitBias: map[string]int{"50256": -101}},
+	} {
+		if err := s.validate(); err == nil {
+			t.Errorf("Invalid sampling accepted: %+v", s)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"reply_sampling": {"temperature": 0.7, "top_p": 0.9},
+		"scheduled_posts": [{
+			"name": "joke",
+			"schedule": "0 9 * * *",
+			"template": "Tell a joke:",
+			"model": "davinci",
+			"temperature": 0.8,
+			"presence_penalty": 0.6,
+			"best_of": 3,
+			"target": "timeline"
+		}]
+	}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post := loaded.ScheduledPosts[0]; post.Temperature != 0.8 || post.PresencePenalty != 0.6 ||
+		post.BestOf != 3 || loaded.ReplySampling.TopP != 0.9 {
+		t.Errorf("Sampling not loaded: %+v, %+v", post.Sampling, loaded.ReplySampling)
+	}
+}
+
+func TestSamplingSentToAPI(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := completionStreamRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.TopP != 0.9 || req.FrequencyPenalty != 0.5 || req.LogitBias["50256"] != -100 ||
+			req.User == "" || req.User == "42" {
+			t.Errorf("Sampling parameters not sent: %+v", req)
+		}
+		if len(req.Stop) != 3 || req.Stop[0] != "\nLiam:" || req.Stop[1] != "\nJames:" || req.Stop[2] != "\n\n" {
+			t.Errorf("Speaker stops not derived from the prompt: %q", req.Stop)
+		}
+		fmt.Fprint(w, `data: {"choices":[{"index":0,"text":"@Liam Sure"}]}`+"\n\n"+"data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool) {
+		OPENAI_COMPLETIONS_URL, STREAM_COMPLETIONS = url, stream
+	}(OPENAI_COMPLETIONS_URL, STREAM_COMPLETIONS)
+	OPENAI_COMPLETIONS_URL, STREAM_COMPLETIONS = server.URL, true
+
+	req := CompletionRequest{
+		Lines:       []Line{{false, "tell me a joke"}},
+		Template:    *StandardTmpl,
+		Model:       GPT35TurboInstruct,
+		UserID:      42,
+		FilterRegex: `\n[a-zA-z0-9]+:`,
+	}
+	Sampling{
+		Temperature:      0.7,
+		TopP:             0.9,
+		FrequencyPenalty: 0.5,
+		Stop:             []string{"\n\n"},
+		LogitBias:        map[string]int{"50256": -100},
+	}.apply(&req)
+
+	text, _, _, err := complete(context.Background(), nil, req)
+	if err != nil || text != "@Liam Sure" {
+		t.Errorf("Wrong completion: %q, err: %v", text, err)
+	}
+}
+
+func TestStopsPastAPILimitWithoutStreaming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := chatRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Stop) != MAX_API_STOPS {
+			t.Errorf("Sent %v stops", len(req.Stop))
+		}
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"@Liam Sure thing\nEND\nmore"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":8}}`))
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool) {
+		OPENAI_CHAT_URL, STREAM_COMPLETIONS = url, stream
+	}(OPENAI_CHAT_URL, STREAM_COMPLETIONS)
+	OPENAI_CHAT_URL, STREAM_COMPLETIONS = server.URL, false
+
+	text, _, _, err := complete(context.Background(), nil, CompletionRequest{
+		Prompt:      "say something",
+		Model:       GPT4oMini,
+		FilterRegex: `\n[a-zA-z0-9]+:`,
+		Stop:        []string{"###", "\n\n", "<|end|>", "STOP", "\nEND"},
+	})
+	if err != nil || text != "@Liam Sure thing" {
+		t.Errorf("Fifth stop not applied: %q, err: %v", text, err)
+	}
+}
+
+func TestCompleteEmptyAfterPostProcessing(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"choices":[{"index":0,"message":{"role":"assistant","content":"https://example.com/buy-now"}}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":8}}`))
+	}))
+	defer server.Close()
+
+	defer func(url string, stream bool, chain *PostProcessChain) {
+		OPENAI_CHAT_URL, STREAM_COMPLETIONS, PostProcessing = url, stream, chain
+	}(OPENAI_CHAT_URL, STREAM_COMPLETIONS, PostProcessing)
+	OPENAI_CHAT_URL, STREAM_COMPLETIONS = server.URL, false
+	PostProcessing, _ = newPostProcessChain(DEFAULT_POST_PROCESSING)
+
+	_, _, verdict, err := complete(context.Background(), nil, CompletionRequest{
+		Prompt:      "where can I buy it?",
+		Model:       GPT4oMini,
+		FilterRegex: `\n[a-zA-z0-9]+:`,
+	})
+	if err != nil || !verdict.Flagged || verdict.Category != "empty" {
+		t.Errorf("Empty completion not flagged: %+v, err: %v", verdict, err)
+	}
+	if calls != 1 {
+		t.Errorf("Called the API %v times for a prompt that only gets empty completions", calls)
+	}
+
+	pool, _ := newFallbackPool(&FallbackConfig{Action: "silent"})
+	if text, ok, err := pool.Resolve(context.Background(), "reply", 1, User{ID: 1}, verdict); ok || text != "" || err != nil {
+		t.Errorf("Silent fallback skipped: %q, %v, err: %v", text, ok, err)
+	}
+}
+
+func checkProcessor(t *testing.T, p PostProcessor, pc PostContext, cases map[string]string) {
+	t.Helper()
+	for in, want := range cases {
+		if got := p.Process(in, pc); got != want {
+			t.Errorf("%v processed %q into %q instead of %q", p.Name(), in, got, want)
+		}
+	}
+}
+
+func TestTrimProcessor(t *testing.T) {
+	checkProcessor(t, &TrimProcessor{}, PostContext{}, map[string]string{
+		"  \n@Liam hi there \n":     "@Liam hi there",
+		"@Liam hi   there,\tfriend": "@Liam hi there, friend",
+		"line one\nline two":        "line one\nline two",
+	})
+}
+
+func TestSentenceProcessor(t *testing.T) {
+	checkProcessor(t, &SentenceProcessor{}, PostContext{}, map[string]string{
+		"Dogs are great. Cats are":         "Dogs are great.",
+		"Really? I think that the":         "Really?",
+		"He said \"go home.\" And then he": "He said \"go home.\"",
+		"Version 3.5 is out and it":        "Version 3.5 is out and it",
+		"Dogs are great. Cats too!":        "Dogs are great. Cats too!",
+		"Dogs are great. Cats too 🐱":       "Dogs are great. Cats too 🐱",
+		"no punctuation at all here":       "no punctuation at all here",
+		"Wait... what is the ":             "Wait...",
+		"":                                 "",
+	})
+}
+
+func TestMentionProcessor(t *testing.T) {
+	checkProcessor(t, &MentionProcessor{Allowed: []string{"@NASA"}}, PostContext{Mentions: []string{"Liam"}},
+		map[string]string{
+			"@Liam ask @elonmusk about it":    "@Liam ask about it",
+			"@liam @randomguy1 @nasa is cool": "@liam @nasa is cool",
+			"@someone, hello":                 ", hello",
+			"mail me at james@example.com":    "mail me at james@example.com",
+		})
+}
+
+func TestHashtagProcessor(t *testing.T) {
+	checkProcessor(t, &HashtagProcessor{}, PostContext{}, map[string]string{
+		"Great day #blessed #mondays": "Great day",
+		"#1 fan of dogs":              "fan of dogs",
+		"Tom &#39;s dogs, issue #3":   "Tom &#39;s dogs, issue",
+		"Nothing to see here":         "Nothing to see here",
+	})
+	checkProcessor(t, &HashtagProcessor{Max: 1}, PostContext{}, map[string]string{
+		"Great day #blessed #mondays #yolo": "Great day #blessed",
+	})
+}
+
+func TestEmojiProcessor(t *testing.T) {
+	checkProcessor(t, &EmojiProcessor{}, PostContext{}, map[string]string{
+		"Good dog 🐶🐶 !":    "Good dog!",
+		"Sunny ☀️ today":   "Sunny today",
+		"Plain text, café": "Plain text, café",
+	})
+	checkProcessor(t, &EmojiProcessor{Max: 2}, PostContext{}, map[string]string{
+		"Wow 👍🏽 🎉 🎉 🎉":     "Wow 👍🏽 🎉",
+		"Family 👨‍👩‍👧 🐶 🐱": "Family 👨‍👩‍👧 🐶",
+	})
+}
+
+func TestProfanityProcessor(t *testing.T) {
+	checkProcessor(t, newProfanityProcessor(DEFAULT_PROFANITY), PostContext{}, map[string]string{
+		"What the Fuck is that":    "What the F*** is that",
+		"This is shitty, damn it":  "This is s*****, d*** it",
+		"Scunthorpe and Dickens":   "Scunthorpe and D******",
+		"Nothing rude in this one": "Nothing rude in this one",
+	})
+	checkProcessor(t, newProfanityProcessor([]string{"heck"}), PostContext{}, map[string]string{
+		"Oh heck, damn": "Oh h***, damn",
+	})
+}
+
+func TestURLProcessor(t *testing.T) {
+	checkProcessor(t, &URLProcessor{}, PostContext{}, map[string]string{
+		"Read this https://example.com/a?b=c now": "Read this now",
+		"See www.example.com.":                    "See",
+		"It's at HTTP://EXAMPLE.COM":              "It's at",
+		"No links, just a.b":                      "No links, just a.b",
+	})
+}
+
+func TestPostProcessChain(t *testing.T) {
+	chain, err := newPostProcessChain(DEFAULT_POST_PROCESSING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := chain.Process("  @Liam @stranger check https://spam.example #ad it's damn good 🎉🎉🎉. And the",
+		PostContext{Mentions: []string{"Liam"}})
+	if text != "@Liam check it's d*** good 🎉🎉." {
+		t.Errorf("Wrong post-processed text: %q", text)
+	}
+
+	var nilChain *PostProcessChain
+	if text := nilChain.Process(" as is ", PostContext{}); text != " as is " {
+		t.Errorf("Nil chain changed the text: %q", text)
+	}
+	if _, err := newPostProcessChain(&PostProcessConfig{Steps: []string{"vibes"}}); err == nil {
+		t.Error("Unknown step accepted")
+	}
+	if _, err := newPostProcessChain(&PostProcessConfig{MaxEmoji: -1}); err == nil {
+		t.Error("Negative limit accepted")
+	}
+}
+
+// A TwitterClient acting as James that talks to handler instead of
+// Twitter. handler also gets the verify_credentials call.
+func newTestTwitterClient(t *testing.T, handler http.HandlerFunc) *TwitterClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	oldApi, oldApiV2 := TwitterApi, TwitterApiV2
+	t.Cleanup(func() { TwitterApi, TwitterApiV2 = oldApi, oldApiV2 })
+	u, _ := url.Parse(server.URL)
+	TwitterApi = url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/1.1"}
+	TwitterApiV2 = url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/2"}
+
+	tc, err := NewTwitterClient(context.Background(), Credentials{AccessToken: "james"}, "bearer", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestUserCredentialsDontAffectReadiness(t *testing.T) {
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Authorization"), `oauth_token="expired"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"code":89,"message":"Invalid or expired token."}]}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	if check := checkCredentials(); !check.OK {
+		t.Fatalf("James's credentials not ready: %+v", check)
+	}
+
+	if _, err := tc.WithUser(context.Background(), Credentials{AccessToken: "expired"}); !IsExpiredToken(err) {
+		t.Fatalf("Expired user token not reported: %v", err)
+	}
+	if check := checkCredentials(); !check.OK {
+		t.Errorf("A tracked user's token made James unready: %+v", check)
+	}
+}
+
+func TestUserAccountSuspendedDoesntPause(t *testing.T) {
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Authorization"), `oauth_token="locked"`) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":[{"code":326,"message":"To protect our users from spam, this account is locked."}]}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	defer setPaused(false)
+
+	if _, err := tc.WithUser(context.Background(), Credentials{AccessToken: "locked"}); !IsAccountSuspended(err) {
+		t.Fatalf("Locked account not reported: %v", err)
+	}
+	if isPaused() {
+		t.Error("A tracked user's locked account paused James")
+	}
+
+	tc.handleError(context.Background(), &TwitterError{Codes: []int{CodeAccountLocked}})
+	if !isPaused() {
+		t.Error("James's own locked account didn't pause him")
+	}
+}
+
+func TestThreadV2BatchesOldAncestors(t *testing.T) {
+	// A thread 1 <- 2 <- ... <- 6 too old for recent search
+	tweet := func(id int) map[string]any {
+		tw := map[string]any{"id": fmt.Sprint(id), "text": fmt.Sprint("tweet ", id), "conversation_id": "1"}
+		if id > 1 {
+			tw["referenced_tweets"] = []map[string]string{{"type": "replied_to", "id": fmt.Sprint(id - 1)}}
+		}
+		return tw
+	}
+
+	lookups := 0
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/2/tweets":
+			lookups++
+			if r.URL.Query().Get("expansions") != "referenced_tweets.id" {
+				t.Errorf("Lookup without expansions: %v", r.URL.RawQuery)
+			}
+			data, includes := []any{}, []any{}
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				var n int
+				fmt.Sscan(id, &n)
+				data = append(data, tweet(n))
+				if n > 1 {
+					includes = append(includes, tweet(n-1))
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": data, "includes": map[string]any{"tweets": includes}})
+		case "/2/tweets/search/recent":
+			w.Write([]byte(`{"meta":{"result_count":0}}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	tc.apiVersion = "2"
+
+	thread, err := tc.Thread(context.Background(), Tweet{ID: 6, InReplyToStatusID: 5, Text: "tweet 6"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 6 || thread[0].Text != "tweet 1" || thread[5].Text != "tweet 6" {
+		t.Errorf("Wrong thread: %+v", thread)
+	}
+	// The tweet itself brings 5, then each lookup brings two more
+	if lookups != 3 {
+		t.Errorf("Made %v lookups instead of 3", lookups)
+	}
+}
+
+func TestThreadStopsPastMaxDepth(t *testing.T) {
+	// A 500 tweet bot loop, each tweet replying to the one before
+	shows := 0
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1.1/statuses/show.json" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		shows++
+		var id int64
+		fmt.Sscan(r.URL.Query().Get("id"), &id)
+		json.NewEncoder(w).Encode(Tweet{ID: id, InReplyToStatusID: id - 1, Text: "again"})
+	})
+
+	limiter := newReplyLimiter(&ReplyLimitsConfig{MaxThreadDepth: 30})
+	thread, err := tc.Thread(context.Background(), Tweet{ID: 500, InReplyToStatusID: 499},
+		limiter.MaxThreadDepth())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shows != 30 || len(thread) != 31 {
+		t.Errorf("Walked %v ancestors into a %v tweet thread, wanted 30 into 31", shows, len(thread))
+	}
+	if reason, ok := limiter.AllowThread(thread[0].ID, len(thread), time.Now()); ok || reason != "thread_depth" {
+		t.Errorf("Cut off thread allowed: %v", reason)
+	}
+}
+
+func rateLimitHeaders(remaining int, reset time.Time) *http.Response {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("x-rate-limit-limit", "15")
+	resp.Header.Set("x-rate-limit-remaining", fmt.Sprint(remaining))
+	resp.Header.Set("x-rate-limit-reset", fmt.Sprint(reset.Unix()))
+	return resp
+}
+
+func TestRateLimiterUpdate(t *testing.T) {
+	rl := NewRateLimiter()
+	reset := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+	rl.Update("statuses_show", rateLimitHeaders(7, reset))
+
+	l := rl.limits["statuses_show"]
+	if l == nil || l.Limit != 15 || l.Remaining != 7 || !l.Reset.Equal(reset) {
+		t.Errorf("Wrong rate limit recorded: %+v", l)
+	}
+
+	// statuses/update doesn't send the headers
+	rl.Update("statuses_update", &http.Response{Header: http.Header{}})
+	if _, ok := rl.limits["statuses_update"]; ok {
+		t.Error("Rate limit recorded without headers")
+	}
+}
+
+func TestRateLimiterWaitNearReserve(t *testing.T) {
+	defer func(slack time.Duration) { RATE_LIMIT_CLOCK_SLACK = slack }(RATE_LIMIT_CLOCK_SLACK)
+	RATE_LIMIT_CLOCK_SLACK = 0
+
+	rl := NewRateLimiter()
+	rl.limits["plenty"] = &rateLimit{Remaining: RATE_LIMIT_RESERVE + 2, Reset: time.Now().Add(time.Hour)}
+	if err := rl.Wait(context.Background(), "plenty"); err != nil {
+		t.Fatal(err)
+	}
+	if rl.limits["plenty"].Remaining != RATE_LIMIT_RESERVE+1 {
+		t.Errorf("Call not counted: %+v", rl.limits["plenty"])
+	}
+
+	// Down to the reserve, so the call waits for the reset
+	rl.limits["low"] = &rateLimit{Remaining: RATE_LIMIT_RESERVE, Reset: time.Now().Add(200 * time.Millisecond)}
+	start := time.Now()
+	if err := rl.Wait(context.Background(), "low"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Errorf("Only waited %v for the reset", waited)
+	}
+
+	// Webhook events don't wait out a whole window
+	rl.limits["low"] = &rateLimit{Remaining: RATE_LIMIT_RESERVE, Reset: time.Now().Add(10 * time.Minute)}
+	ctx := withMaxRateLimitWait(context.Background(), time.Second)
+	if err := rl.Wait(ctx, "low"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Long wait not refused: %v", err)
+	}
+}
+
+func TestTwitterRetriesAfter429(t *testing.T) {
+	defer func(slack time.Duration) { RATE_LIMIT_CLOCK_SLACK = slack }(RATE_LIMIT_CLOCK_SLACK)
+	RATE_LIMIT_CLOCK_SLACK = 0
+
+	shows, reset := 0, time.Now()
+	tc := newTestTwitterClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1.1/statuses/show.json" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		shows++
+		if shows == 1 {
+			w.Header().Set("x-rate-limit-reset", fmt.Sprint(reset.Unix()))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"errors":[{"code":88,"message":"Rate limit exceeded"}]}`))
+			return
+		}
+		w.Write([]byte(`{"id":5,"text":"hi"}`))
+	})
+
+	tweet, err := tc.ShowTweet(context.Background(), 5)
+	if err != nil || tweet.Text != "hi" || shows != 2 {
+		t.Errorf("429 not retried: %+v, %v calls, err: %v", tweet, shows, err)
+	}
+
+	// Still limited for the next 15 minutes
+	shows, reset = 0, time.Now().Add(15*time.Minute)
+	ctx := withMaxRateLimitWait(context.Background(), time.Second)
+	if _, err := tc.ShowTweet(ctx, 5); !errors.Is(err, ErrRateLimited) || shows != 1 {
+		t.Errorf("Waited out the window: %v calls, err: %v", shows, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Everything James exports on /metrics lives here so the names
+// stay consistent across the pipeline
+
+var webhookEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_webhook_events_total",
+	Help: "Webhook events received, by type.",
+}, []string{"type"})
+
+var eventsFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_events_filtered_total",
+	Help: "Webhook events James did not reply to, by reason.",
+}, []string{"reason"})
+
+var replyLoopsDetected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "james_reply_loops_detected_total",
+	Help: "Users muted for answering James like a bot would, see ReplyLimitsConfig.",
+})
+
+var completionLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "james_completion_duration_seconds",
+	Help:    "Time spent waiting on a single completion call.",
+	Buckets: prometheus.ExponentialBuckets(0.25, 2, 8),
+}, []string{"model"})
+
+var completionTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_tokens_total",
+	Help: "Tokens used by completion calls, by model and kind (prompt or completion).",
+}, []string{"model", "kind"})
+
+var completionCost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_cost_dollars_total",
+	Help: "What completion calls cost according to the model prices, by model.",
+}, []string{"model"})
+
+var budgetActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_budget_actions_total",
+	Help: "Completions affected by the budget, by action (degrade to a cheaper model or refuse).",
+}, []string{"action"})
+
+var streamsCut = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_streams_cut_total",
+	Help: "Completion streams cancelled early because FilterRegex or a stop sequence matched.",
+}, []string{"model"})
+
+var modelFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_model_fallbacks_total",
+	Help: "Requests that moved on to their next model, by the model given up on and why (error, timeout or budget).",
+}, []string{"model", "reason"})
+
+var completionCandidates = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_candidates_total",
+	Help: "Completion candidates, by model and moderation result (passed or flagged), or empty if post-processing left nothing.",
+}, []string{"model", "result"})
+
+var postProcessChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_post_process_changes_total",
+	Help: "Completion candidates a post-processing step changed, by step.",
+}, []string{"step"})
+
+var completionCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_cache_lookups_total",
+	Help: "Completion cache lookups, by result (hit, miss, or bypass for templates that aren't cached).",
+}, []string{"result"})
+
+var completionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_completion_errors_total",
+	Help: "Completion calls that returned an error.",
+}, []string{"model"})
+
+var moderationVerdicts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_moderation_verdicts_total",
+	Help: "Moderation verdicts, by stage (input or output), result (passed or flagged), and the moderator and category that flagged the text.",
+}, []string{"stage", "result", "moderator", "category"})
+
+var moderationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_moderation_errors_total",
+	Help: "Moderator calls that returned an error, by moderator.",
+}, []string{"moderator"})
+
+var sensitivityRetries = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "james_sensitivity_retries",
+	Help:    "Number of retries needed per request because moderation flagged the completion.",
+	Buckets: prometheus.LinearBuckets(0, 1, MAX_COMPLETION_RETRIES+1),
+})
+
+var defaultResponses = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "james_default_responses_total",
+	Help: "Requests that fell back to DEFAULT_RESPONSE after max retries.",
+})
+
+var fallbackActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_fallback_actions_total",
+	Help: "What James did instead of posting a flagged completion, by kind and action (respond, silent or approval).",
+}, []string{"kind", "action"})
+
+var approvalsPending = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "james_approvals_pending",
+	Help: "Tweets waiting for approval through the admin API.",
+})
+
+var tweetsPosted = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_tweets_posted_total",
+	Help: "Tweets successfully posted, by kind (reply or scheduled post name).",
+}, []string{"kind"})
+
+var tweetsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_tweets_failed_total",
+	Help: "Tweets that could not be posted, by kind (reply or scheduled post name).",
+}, []string{"kind"})
+
+var twitterRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "james_twitter_rate_limit_remaining",
+	Help: "Requests left in the current Twitter rate limit window, by endpoint.",
+}, []string{"endpoint"})
+
+var twitterRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_twitter_rate_limited_total",
+	Help: "Twitter calls that got a 429, by endpoint.",
+}, []string{"endpoint"})
+
+var directMessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_direct_messages_sent_total",
+	Help: "Direct messages successfully sent, by scheduled post name.",
+}, []string{"kind"})
+
+var directMessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_direct_messages_failed_total",
+	Help: "Direct messages that could not be sent, by scheduled post name.",
+}, []string{"kind"})
+
+var subscriptionCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_subscription_commands_total",
+	Help: "Subscribe and unsubscribe commands tweeted at James, by topic and action.",
+}, []string{"topic", "action"})
+
+var scheduledJobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_scheduled_job_runs_total",
+	Help: "Scheduled job runs, by job and result (ok or error).",
+}, []string{"job", "result"})
+
+var goroutineRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "james_goroutine_restarts_total",
+	Help: "Background goroutines restarted after failing, by name.",
+}, []string{"goroutine"})
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "james_queue_depth",
+	Help: "Number of completion requests waiting in JamesBuffer.",
+}, func() float64 { return float64(len(JamesBuffer)) })
+
+// A post only counts as successful if Twitter accepted it,
+// in which case we get the new tweet back. Those are kept
+// for the duplicate scorer too.
+func recordTweetPost(kind string, posted Tweet, err error) {
+	if err != nil || posted.ID == 0 {
+		tweetsFailed.WithLabelValues(kind).Inc()
+	} else {
+		tweetsPosted.WithLabelValues(kind).Inc()
+		RecentPosts.Add(posted.Text)
+	}
+}
+
+func recordDirectMessage(kind string, err error) {
+	if err != nil {
+		directMessagesFailed.WithLabelValues(kind).Inc()
+	} else {
+		directMessagesSent.WithLabelValues(kind).Inc()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest a single completion call can take before the next model in
+// the request's chain is tried, for models that don't set their own
+var COMPLETION_TIMEOUT time.Duration = 30 * time.Second
+
+// How a model is called
+type APIStyle string
+
+const (
+	// One prompt string in, text out (/v1/completions)
+	StyleCompletion APIStyle = "completion"
+	// A system message and a list of user and assistant
+	// messages in, one message out (/v1/chat/completions)
+	StyleChat APIStyle = "chat"
+)
+
+// Everything James needs to know about a model. Models are added or
+// overridden through the "models" section of the config.
+//
+//	"models": [{
+//	  "name": "fast",
+//	  "id": "gpt-4o-mini",
+//	  "style": "chat",
+//	  "context_length": 128000,
+//	  "prompt_price": 0.00015,
+//	  "completion_price": 0.0006
+//	}, {
+//	  "name": "local",
+//	  "id": "llama3",
+//	  "style": "chat",
+//	  "context_length": 8192,
+//	  "base_url": "http://localhost:11434/v1",
+//	  "timeout": "1m"
+//	}]
+type Model struct {
+	// What requests and the config call it
+	Name string `json:"name"`
+	// What the API calls it, defaults to Name
+	ID    string   `json:"id"`
+	Style APIStyle `json:"style"`
+	// Max tokens of prompt and completion together
+	ContextLength int `json:"context_length"`
+	// In dollars per 1000 tokens
+	PromptPrice     float64 `json:"prompt_price"`
+	CompletionPrice float64 `json:"completion_price"`
+
+	// OpenAI compatible API the model is served from, i.e. a local
+	// llama.cpp or Ollama server. Defaults to OpenAI, which needs
+	// prices. A BaseURL model without prices is free.
+	BaseURL string `json:"base_url,omitempty"`
+	// Environment variable with the API key. Defaults to
+	// OPENAI_API_KEY for OpenAI, and no key for a BaseURL.
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// Defaults to COMPLETION_TIMEOUT
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// Names of the models James has used over time. Most of them have been
+// retired by OpenAI, they're kept so old configs still load.
+const (
+	Ada                = "ada"
+	Babbage            = "babbage"
+	Curie              = "curie"
+	Davinci            = "davinci"
+	DavinciInstruct    = "davinci-instruct-beta"
+	CurieInstruct      = "curie-instruct-beta"
+	GPT35TurboInstruct = "gpt-3.5-turbo-instruct"
+	GPT35Turbo         = "gpt-3.5-turbo"
+	GPT4oMini          = "gpt-4o-mini"
+)
+
+var DEFAULT_MODELS = []*Model{
+	{Name: Ada, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.0008, CompletionPrice: 0.0008},
+	{Name: Babbage, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.0012, CompletionPrice: 0.0012},
+	{Name: Curie, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.006, CompletionPrice: 0.006},
+	{Name: Davinci, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.06, CompletionPrice: 0.06},
+	{Name: DavinciInstruct, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.06, CompletionPrice: 0.06},
+	{Name: CurieInstruct, Style: StyleCompletion, ContextLength: 2049, PromptPrice: 0.006, CompletionPrice: 0.006},
+	{Name: GPT35TurboInstruct, Style: StyleCompletion, ContextLength: 4096, PromptPrice: 0.0015, CompletionPrice: 0.002},
+	{Name: GPT35Turbo, Style: StyleChat, ContextLength: 16385, PromptPrice: 0.0005, CompletionPrice: 0.0015},
+	{Name: GPT4oMini, Style: StyleChat, ContextLength: 128000, PromptPrice: 0.00015, CompletionPrice: 0.0006},
+}
+
+type ModelRegistry struct {
+	models map[string]*Model
+}
+
+// The models requests can ask for. Set in main from the config,
+// only the defaults until then.
+var Models = mustModelRegistry(nil)
+
+// The default models, plus the ones given, which replace
+// defaults that have the same name
+func newModelRegistry(models []*Model) (*ModelRegistry, error) {
+	r := &ModelRegistry{models: map[string]*Model{}}
+	for _, m := range append(append([]*Model{}, DEFAULT_MODELS...), models...) {
+		if m.Name == "" {
+			return nil, fmt.Errorf("Model needs a name")
+		}
+		if m.Style != StyleCompletion && m.Style != StyleChat {
+			return nil, fmt.Errorf("Model %q has unknown style %q", m.Name, m.Style)
+		}
+		if m.ContextLength <= 0 {
+			return nil, fmt.Errorf("Model %q needs a context length", m.Name)
+		}
+		if m.PromptPrice < 0 || m.CompletionPrice < 0 {
+			return nil, fmt.Errorf("Model %q can't have negative prices", m.Name)
+		}
+		// Otherwise it would skip the budgets and count as $0
+		if m.BaseURL == "" && m.PromptPrice == 0 && m.CompletionPrice == 0 {
+			return nil, fmt.Errorf("Model %q is served by OpenAI and needs prompt_price and completion_price", m.Name)
+		}
+
+		model := *m
+		if model.ID == "" {
+			model.ID = model.Name
+		}
+		r.models[model.Name] = &model
+	}
+	return r, nil
+}
+
+func mustModelRegistry(models []*Model) *ModelRegistry {
+	r, err := newModelRegistry(models)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *ModelRegistry) Get(name string) (*Model, error) {
+	m, ok := r.models[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown model %q", name)
+	}
+	return m, nil
+}
+
+// Whether any of the named models is free, so a request trying
+// them in turn still gets a completion once the budget is spent
+func (r *ModelRegistry) AnyFree(names []string) bool {
+	for _, name := range names {
+		if m, err := r.Get(name); err == nil && m.free() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ModelRegistry) List() []*Model {
+	models := []*Model{}
+	for _, m := range r.models {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models
+}
+
+func (m *Model) chatURL() string {
+	if m.BaseURL == "" {
+		return OPENAI_CHAT_URL
+	}
+	return strings.TrimSuffix(m.BaseURL, "/") + "/chat/completions"
+}
+
+func (m *Model) completionsURL() string {
+	if m.BaseURL == "" {
+		return OPENAI_COMPLETIONS_URL
+	}
+	return strings.TrimSuffix(m.BaseURL, "/") + "/completions"
+}
+
+// Never the OpenAI key for somebody else's server
+func (m *Model) apiKey() string {
+	if m.APIKeyEnv != "" {
+		return os.Getenv(m.APIKeyEnv)
+	} else if m.BaseURL != "" {
+		return ""
+	}
+	return os.Getenv("OPENAI_API_KEY")
+}
+
+func (m *Model) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return time.Duration(m.Timeout)
+	}
+	return COMPLETION_TIMEOUT
+}
+
+// Models on our own servers without prices cost nothing, and are
+// still allowed once the budget is spent. OpenAI always bills, see
+// newModelRegistry.
+func (m *Model) free() bool {
+	return m.BaseURL != "" && m.PromptPrice == 0 && m.CompletionPrice == 0
+}
+
+// Dollars spent on a call
+func (m *Model) Cost(promptTokens int, completionTokens int) float64 {
+	return (float64(promptTokens)*m.PromptPrice + float64(completionTokens)*m.CompletionPrice) / 1000
+}
+
+// A rough count, good enough to keep prompts under the context length.
+// Tokens are roughly 4 english chars.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
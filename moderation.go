@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gogpt "github.com/sashabaranov/go-gpt3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var OPENAI_MODERATION_URL string = "https://api.openai.com/v1/moderations"
+
+// Number of flagged verdicts we keep around for the admin API
+var MAX_RECENT_VERDICTS int = 50
+
+// Threshold for categories that aren't in the config
+var DEFAULT_MODERATION_THRESHOLD float64 = 0.5
+
+// Used when the config has no moderation section
+var DEFAULT_MODERATION = &ModerationConfig{
+	Moderators:  []string{"rules", "openai"},
+	Thresholds:  map[string]float64{},
+	InputAction: "silence",
+}
+
+// Moderation settings from the config
+//
+//	"moderation": {
+//	  "moderators": ["rules", "openai"],
+//	  "thresholds": {"default": 0.5, "violence": 0.8},
+//	  "rules": [{"category": "spam", "words": ["crypto", "giveaway"]}],
+//	  "fail_open": false,
+//	  "input_action": "deflect",
+//	  "deflections": ["I'd rather not get into that one."]
+//	}
+type ModerationConfig struct {
+	// Run in this order, the first one to flag the text decides. Any
+	// of "rules", "openai", "classifier" and "content_filter".
+	Moderators []string `json:"moderators"`
+	// Score from 0 to 1 at which a category is flagged. "default"
+	// covers every category that isn't listed.
+	Thresholds map[string]float64 `json:"thresholds"`
+	Rules      []*ModerationRule  `json:"rules"`
+	// If a moderator fails, let the text through instead of
+	// failing the whole request
+	FailOpen bool `json:"fail_open"`
+
+	// What James does when a tweet (or the thread it's in) is
+	// flagged: "silence" ignores it, "deflect" replies with one of
+	// the deflections picked at random. Either way no completion
+	// is made for it.
+	InputAction string   `json:"input_action"`
+	Deflections []string `json:"deflections"`
+}
+
+// A local rule, flags its category if any of the words (matched
+// whole, ignoring case) or the regex pattern is found
+type ModerationRule struct {
+	Category string   `json:"category"`
+	Words    []string `json:"words"`
+	Pattern  string   `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+func (c *ModerationConfig) compile() error {
+	for _, name := range c.Moderators {
+		switch name {
+		case "rules", "openai", "classifier", "content_filter":
+		default:
+			return fmt.Errorf("Unknown moderator %q", name)
+		}
+	}
+	switch c.InputAction {
+	case "":
+		c.InputAction = "silence"
+	case "silence":
+	case "deflect":
+		if len(c.Deflections) == 0 {
+			return errors.New(`Moderation input action "deflect" needs deflections`)
+		}
+	default:
+		return fmt.Errorf("Unknown moderation input action %q", c.InputAction)
+	}
+	for category, threshold := range c.Thresholds {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("Moderation threshold for %q has to be between 0 and 1", category)
+		}
+	}
+
+	for _, rule := range c.Rules {
+		if rule.Category == "" {
+			return errors.New("Moderation rule needs a category")
+		}
+
+		alternatives := []string{}
+		if len(rule.Words) > 0 {
+			words := []string{}
+			for _, w := range rule.Words {
+				words = append(words, regexp.QuoteMeta(w))
+			}
+			alternatives = append(alternatives, `(?i)\b(?:`+strings.Join(words, "|")+`)\b`)
+		}
+		if rule.Pattern != "" {
+			alternatives = append(alternatives, rule.Pattern)
+		}
+		if len(alternatives) == 0 {
+			return fmt.Errorf("Moderation rule for %q needs words or a pattern", rule.Category)
+		}
+
+		var err error
+		if rule.re, err = regexp.Compile(strings.Join(alternatives, "|")); err != nil {
+			return fmt.Errorf("Moderation rule for %q: %w", rule.Category, err)
+		}
+	}
+	return nil
+}
+
+// A Moderator scores text from 0 (fine) to 1 (definitely not fine)
+// in each category it knows about. The reason is for humans reading
+// the logs, i.e. the word that matched.
+type Moderator interface {
+	Name() string
+	Moderate(ctx context.Context, text string) (scores map[string]float64, reason string, err error)
+}
+
+// What moderation decided about a piece of text
+type Verdict struct {
+	// "input" for tweets sent to James, "output" for what he says
+	Stage     string    `json:"stage"`
+	Flagged   bool      `json:"flagged"`
+	Moderator string    `json:"moderator,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	Score     float64   `json:"score,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type ModerationChain struct {
+	moderators  []Moderator
+	thresholds  map[string]float64
+	failOpen    bool
+	inputAction string
+	deflections []string
+}
+
+// The moderation everything James reads and writes goes through. Set in main.
+var Moderation *ModerationChain
+
+func newModerationChain(c *ModerationConfig) *ModerationChain {
+	chain := &ModerationChain{
+		thresholds:  c.Thresholds,
+		failOpen:    c.FailOpen,
+		inputAction: c.InputAction,
+		deflections: c.Deflections,
+	}
+	for _, name := range c.Moderators {
+		switch name {
+		case "rules":
+			chain.moderators = append(chain.moderators, &RulesModerator{c.Rules})
+		case "openai":
+			chain.moderators = append(chain.moderators, &OpenAIModerator{
+				apiKey: os.Getenv("OPENAI_API_KEY"),
+				client: &http.Client{Timeout: 10 * time.Second},
+			})
+		case "classifier":
+			chain.moderators = append(chain.moderators, &ClassifierModerator{})
+		case "content_filter":
+			chain.moderators = append(chain.moderators, &ContentFilterModerator{
+				gogpt.NewClient(os.Getenv("OPENAI_API_KEY")),
+			})
+		}
+	}
+	return chain
+}
+
+// Runs the text through every moderator until one flags it. A nil
+// chain lets everything through.
+func (chain *ModerationChain) Check(ctx context.Context, stage string, text string) (verdict Verdict, err error) {
+	verdict = Verdict{Stage: stage, Time: time.Now()}
+	if chain == nil {
+		return verdict, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "james.moderate",
+		trace.WithAttributes(attribute.String("moderation.stage", stage)))
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("moderation.flagged", verdict.Flagged),
+			attribute.String("moderation.moderator", verdict.Moderator),
+			attribute.String("moderation.category", verdict.Category))
+		endSpan(span, err)
+	}()
+	log := logger(ctx)
+
+	for _, m := range chain.moderators {
+		scores, reason, err := m.Moderate(ctx, text)
+		if err != nil {
+			moderationErrors.WithLabelValues(m.Name()).Inc()
+			if chain.failOpen {
+				log.Warn("Moderator failed, skipping it", "moderator", m.Name(), "err", err)
+				continue
+			}
+			return verdict, fmt.Errorf("%v moderator: %w", m.Name(), err)
+		}
+
+		category, score, flagged := chain.worst(scores)
+		if !flagged {
+			continue
+		}
+
+		verdict.Flagged = true
+		verdict.Moderator = m.Name()
+		verdict.Category = category
+		verdict.Score = score
+		verdict.Reason = reason
+		verdict.Text = text
+		recordVerdict(verdict)
+		log.Info("Text flagged by moderation", "stage", stage, "moderator", m.Name(),
+			"category", category, "score", score, "reason", reason, "text", text)
+		return verdict, nil
+	}
+
+	recordVerdict(verdict)
+	return verdict, nil
+}
+
+// The category furthest over its threshold, if any
+func (chain *ModerationChain) worst(scores map[string]float64) (string, float64, bool) {
+	categories := []string{}
+	for category := range scores {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	worst, worstScore, worstOver := "", 0.0, -1.0
+	for _, category := range categories {
+		threshold, ok := chain.thresholds[category]
+		if !ok {
+			threshold, ok = chain.thresholds["default"]
+		}
+		if !ok {
+			threshold = DEFAULT_MODERATION_THRESHOLD
+		}
+
+		score := scores[category]
+		if over := score - threshold; score >= threshold && over > worstOver {
+			worst, worstScore, worstOver = category, score, over
+		}
+	}
+	return worst, worstScore, worstOver >= 0
+}
+
+// Screens what was said to James before a completion is spent on it.
+// The tweet goes first, since that doesn't need the thread, and then
+// the rest of what others said in the thread, all in one go.
+func (chain *ModerationChain) CheckInput(ctx context.Context, t Tweet, thread func() ([]Line, error)) (Verdict, []Line, error) {
+	verdict, err := chain.Check(ctx, "input", t.Text)
+	if err != nil || verdict.Flagged {
+		return verdict, nil, err
+	}
+
+	lines, err := thread()
+	if err != nil {
+		return verdict, nil, err
+	}
+
+	earlier := []string{}
+	for i, line := range lines {
+		if !line.IsJames && i < len(lines)-1 {
+			earlier = append(earlier, line.Text)
+		}
+	}
+	if len(earlier) > 0 {
+		verdict, err = chain.Check(ctx, "input", strings.Join(earlier, "\n"))
+	}
+	return verdict, lines, err
+}
+
+// Answers a tweet that was flagged, with silence or a deflection,
+// depending on the config
+func (chain *ModerationChain) RespondToFlagged(ctx context.Context, t Tweet, verdict Verdict) error {
+	eventsFiltered.WithLabelValues("moderated").Inc()
+	log := logger(ctx).With("tweet_id", t.ID, "user_id", t.User.ID,
+		"moderator", verdict.Moderator, "category", verdict.Category, "reason", verdict.Reason)
+
+	if chain == nil || chain.inputAction != "deflect" {
+		log.Info("Not replying to flagged tweet")
+		return nil
+	}
+
+	status := "@" + t.User.ScreenName + " " + chain.deflections[rand.Intn(len(chain.deflections))]
+	posted, err := Twitter.PostStatus(ctx, status, t.ID)
+	recordTweetPost("deflection", posted, err)
+	if IsDuplicateStatus(err) {
+		// Same deflection as last time, staying quiet is just as good
+		log.Info("Deflection was a duplicate, not replying to flagged tweet")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	log.Info("Deflected flagged tweet", "response", status, "reply_id", posted.ID)
+	return nil
+}
+
+var (
+	recentVerdicts   []Verdict
+	recentVerdictsMu sync.Mutex
+)
+
+// Counts every verdict, and keeps the last MAX_RECENT_VERDICTS
+// flagged ones around for the admin API, newest last
+func recordVerdict(v Verdict) {
+	if !v.Flagged {
+		moderationVerdicts.WithLabelValues(v.Stage, "passed", "", "").Inc()
+		return
+	}
+	moderationVerdicts.WithLabelValues(v.Stage, "flagged", v.Moderator, v.Category).Inc()
+
+	recentVerdictsMu.Lock()
+	defer recentVerdictsMu.Unlock()
+
+	recentVerdicts = append(recentVerdicts, v)
+	if over := len(recentVerdicts) - MAX_RECENT_VERDICTS; over > 0 {
+		recentVerdicts = recentVerdicts[over:]
+	}
+}
+
+func getRecentVerdicts() []Verdict {
+	recentVerdictsMu.Lock()
+	defer recentVerdictsMu.Unlock()
+
+	return append([]Verdict{}, recentVerdicts...)
+}
+
+// Local word lists and regexes, no network involved
+type RulesModerator struct {
+	rules []*ModerationRule
+}
+
+func (m *RulesModerator) Name() string { return "rules" }
+
+func (m *RulesModerator) Moderate(ctx context.Context, text string) (map[string]float64, string, error) {
+	scores := map[string]float64{}
+	reasons := []string{}
+	for _, rule := range m.rules {
+		if match := rule.re.FindString(text); match != "" {
+			scores[rule.Category] = 1
+			reasons = append(reasons, fmt.Sprintf("%v matched %q", rule.Category, match))
+		}
+	}
+	return scores, strings.Join(reasons, "; "), nil
+}
+
+// https://platform.openai.com/docs/guides/moderation
+type OpenAIModerator struct {
+	apiKey string
+	client *http.Client
+}
+
+func (m *OpenAIModerator) Name() string { return "openai" }
+
+func (m *OpenAIModerator) Moderate(ctx context.Context, text string) (map[string]float64, string, error) {
+	payload, err := json.Marshal(struct {
+		Input string `json:"input"`
+	}{text})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", OPENAI_MODERATION_URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.apiKey)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Moderation endpoint returned %v: %s", resp.StatusCode, body)
+	}
+
+	result := struct {
+		Results []struct {
+			Flagged        bool               `json:"flagged"`
+			Categories     map[string]bool    `json:"categories"`
+			CategoryScores map[string]float64 `json:"category_scores"`
+		} `json:"results"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, "", err
+	}
+	if len(result.Results) == 0 {
+		return nil, "", errors.New("Moderation endpoint returned no results")
+	}
+
+	// We go by our own thresholds, but note what OpenAI thought
+	flagged := []string{}
+	for category, f := range result.Results[0].Categories {
+		if f {
+			flagged = append(flagged, category)
+		}
+	}
+	sort.Strings(flagged)
+	reason := ""
+	if len(flagged) > 0 {
+		reason = "OpenAI flagged " + strings.Join(flagged, ", ")
+	}
+	return result.Results[0].CategoryScores, reason, nil
+}
+
+// Placeholder for a classifier running next to James, so moderation
+// doesn't always need a network call. Scores nothing until one is
+// plugged in here.
+type ClassifierModerator struct{}
+
+func (m *ClassifierModerator) Name() string { return "classifier" }
+
+func (m *ClassifierModerator) Moderate(ctx context.Context, text string) (map[string]float64, string, error) {
+	return map[string]float64{}, "", nil
+}
+
+// The old content-filter-alpha-c4 labels, where 2 (unsafe) scores 1
+// and 1 (sensitive) scores 0.25, below DEFAULT_MODERATION_THRESHOLD,
+// so only unsafe text is flagged unless the "unsafe" threshold is
+// lowered. The model has been retired, this is only kept for accounts
+// that still have access to it.
+type ContentFilterModerator struct {
+	c *gogpt.Client
+}
+
+func (m *ContentFilterModerator) Name() string { return "content_filter" }
+
+func (m *ContentFilterModerator) Moderate(ctx context.Context, text string) (map[string]float64, string, error) {
+	label, err := checkSensitivity(text, ctx, m.c)
+	if err != nil {
+		return nil, "", err
+	}
+	return map[string]float64{"unsafe": contentFilterScore(label)},
+		fmt.Sprintf("content filter label %v", label), nil
+}
+
+func contentFilterScore(label int) float64 {
+	switch label {
+	case 2:
+		return 1
+	case 1:
+		return 0.25
+	}
+	return 0
+}
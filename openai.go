@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	gogpt "github.com/sashabaranov/go-gpt3"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"os"
 	"regexp"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 // Number of times we'll retry generating a prompt thats unsafe
@@ -18,116 +29,575 @@ var MAX_COMPLETION_RETRIES int = 5
 var DEFAULT_RESPONSE string = "*Yaaaawn*... eh, I dont really feel like it"
 
 type CompletionRequest struct {
-	Prompt       string
-	FilterRegex  string
+	// Either a ready Prompt, or the Lines of a conversation. Completion
+	// models get the lines rendered with Template, chat models get
+	// System as the system message and a message per line.
+	Prompt   string
+	Lines    []Line
+	Template template.Template
+	System   string
+
+	FilterRegex string
+	// Where the completion ends, i.e. where it starts making up the
+	// next speaker's line. Unlike FilterRegex, these are also sent to
+	// the API. For completion models, the speaker labels of the prompt
+	// are added to these.
+	Stop         []string
 	ResponseChan chan CompletionResponse
-	Model        ModelEnum
-	Temperature  float32
-	Tokens       int
-}
+	// What the prompt was made from, for the cache's per template
+	// settings. Defaults to the name of Template.
+	TemplateName string
+	// Who the completion is for, 0 if nobody in particular.
+	// Counts towards their budget.
+	UserID int64
+	// Screen names the completion may mention, see MentionProcessor
+	Mentions []string
+	// Name of a model in Models
+	Model string
+	// Tried in order if Model fails, times out or is over budget
+	FallbackModels []string
 
-type CompletionResponse struct {
-	Response string
-	Err      error
-}
+	Temperature      float32
+	TopP             float32
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	LogitBias        map[string]int
+	BestOf           int
+	// Who the completion is for as far as OpenAI is concerned,
+	// derived from UserID if empty
+	User   string
+	Tokens int
+	// Completions made in one call for Reranking to pick from,
+	// 0 uses the number from the config
+	Candidates int
+	// Ask the API for log probabilities, set when a scorer needs them
+	LogProbs bool
 
-type ModelEnum struct{ *string }
+	// Ties the logs of this request to the event that caused it
+	CorrelationID string
 
-func (e ModelEnum) String() string {
-	if e.string == nil {
-		return "<void>"
-	}
-	return *e.string
+	// Carries the trace of the event that caused this request, and
+	// the time it was put on the buffer so we can see the queue wait
+	Context  context.Context
+	Enqueued time.Time
+}
+
+// How tokens are picked, settable per template in the config. Zero
+// values leave the API's defaults, apart from Temperature.
+//
+//	"temperature": 0.8,
+//	"top_p": 0.95,
+//	"presence_penalty": 0.5,
+//	"frequency_penalty": 0.5,
+//	"stop": ["\n\n"],
+//	"logit_bias": {"50256": -100},
+//	"best_of": 3
+type Sampling struct {
+	Temperature      float32 `json:"temperature"`
+	TopP             float32 `json:"top_p,omitempty"`
+	PresencePenalty  float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32 `json:"frequency_penalty,omitempty"`
+	// On top of the stops derived from the speakers of the prompt
+	Stop []string `json:"stop,omitempty"`
+	// Token ID to a bias from -100 (never) to 100 (always)
+	LogitBias map[string]int `json:"logit_bias,omitempty"`
+	// Completions made on OpenAI's side to send back the best of.
+	// Only for completion models, and turns off streaming.
+	BestOf int `json:"best_of,omitempty"`
+	// Defaults to a hash of the Twitter user the completion is for
+	User string `json:"user,omitempty"`
 }
 
-func (e ModelEnum) IsValid() bool {
-	for _, m := range []ModelEnum{Ada, Babbage, Curie, Davinci, DavinciInstruct, CurieInstruct} {
-		if m == e {
-			return true
+func (s *Sampling) validate() error {
+	switch {
+	case s.Temperature < 0 || s.Temperature > 2:
+		return errors.New("Temperature has to be between 0 and 2")
+	case s.TopP < 0 || s.TopP > 1:
+		return errors.New("top_p has to be between 0 and 1")
+	case s.PresencePenalty < -2 || s.PresencePenalty > 2,
+		s.FrequencyPenalty < -2 || s.FrequencyPenalty > 2:
+		return errors.New("Penalties have to be between -2 and 2")
+	case s.BestOf < 0:
+		return errors.New("best_of can't be negative")
+	}
+	for token, bias := range s.LogitBias {
+		if bias < -100 || bias > 100 {
+			return fmt.Errorf("Logit bias of token %v has to be between -100 and 100", token)
 		}
 	}
-	return false
+	return nil
 }
 
-// Not a great way to do enums in golang
-var (
-	es = []string{"ada", "babbage", "curie", "davinci", "davinci-instruct-beta", "curie-instruct-beta"}
+// Sets the sampling parameters of a request
+func (s Sampling) apply(request *CompletionRequest) {
+	request.Temperature = s.Temperature
+	request.TopP = s.TopP
+	request.PresencePenalty = s.PresencePenalty
+	request.FrequencyPenalty = s.FrequencyPenalty
+	request.Stop = append(append([]string{}, request.Stop...), s.Stop...)
+	request.LogitBias = s.LogitBias
+	request.BestOf = s.BestOf
+	request.User = s.User
+}
 
-	Ada             = ModelEnum{&es[0]}
-	Babbage         = ModelEnum{&es[1]}
-	Curie           = ModelEnum{&es[2]}
-	Davinci         = ModelEnum{&es[3]}
-	DavinciInstruct = ModelEnum{&es[4]}
-	CurieInstruct   = ModelEnum{&es[5]}
-)
+type CompletionResponse struct {
+	Response string
+	// Name of the model that made Response, Model of the
+	// request or one of its FallbackModels
+	Model string
+	Err   error
+	// What output moderation said about the last completion,
+	// flagged if Response is DEFAULT_RESPONSE because of it
+	Verdict Verdict
+}
+
+// Serves requests from buffer until it's closed, in which case it
+// returns nil. Any other return means the worker failed and should
+// be restarted.
+func runCompletions(buffer chan CompletionRequest) error {
+	atomic.AddInt32(&completionWorkers, 1)
+	defer atomic.AddInt32(&completionWorkers, -1)
 
-func runCompletions(buffer chan CompletionRequest) {
 	c := gogpt.NewClient(os.Getenv("OPENAI_API_KEY"))
-	ctx := context.Background()
 
 	for {
 		request, more := <-buffer
 
 		// If the buffer is closed, kill this goroutine
 		if !more {
-			log.Printf("Request buffer closed. Closing completion backend")
-			return
-		} else if !request.Model.IsValid() {
-			// Make sure we have a valid model requested
-			request.ResponseChan <- CompletionResponse{
-				Response: "",
-				Err: errors.New("Requested invalid model: " +
-					request.Model.String()),
-			}
-		} else {
-			req := gogpt.CompletionRequest{
-				MaxTokens:   request.Tokens,
-				Prompt:      request.Prompt,
-				Temperature: request.Temperature,
+			slog.Info("Request buffer closed, closing completion backend")
+			return nil
+		}
+
+		if err := serveCompletion(c, request); err != nil {
+			return err
+		}
+	}
+}
+
+// Answers a single request. If it panics, the requester still gets
+// an error back, and the panic is returned so the worker is restarted.
+func serveCompletion(c *gogpt.Client, request CompletionRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic serving completion: %v\n%s", r, debug.Stack())
+			request.ResponseChan <- CompletionResponse{Err: err}
+			close(request.ResponseChan)
+		}
+	}()
+
+	ctx := request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !request.Enqueued.IsZero() {
+		_, wait := tracer.Start(ctx, "james.queue_wait",
+			trace.WithTimestamp(request.Enqueued))
+		wait.End()
+	}
+	ctx, span := tracer.Start(ctx, "james.completion",
+		trace.WithAttributes(attribute.String("model", request.Model)))
+
+	respText, model, verdict, completionErr := complete(ctx, c, request)
+	span.SetAttributes(attribute.String("model.used", model))
+	endSpan(span, completionErr)
+
+	request.ResponseChan <- CompletionResponse{
+		Response: respText,
+		Model:    model,
+		Err:      completionErr,
+		Verdict:  verdict,
+	}
+	close(request.ResponseChan)
+	return nil
+}
+
+// A model call that failed or timed out. complete moves on to the
+// next model in the request's chain when it gets one.
+type ModelError struct {
+	Model string
+	Err   error
+}
+
+func (e *ModelError) Error() string {
+	return fmt.Sprintf("Completion with %v failed: %v", e.Model, e.Err)
+}
+
+func (e *ModelError) Unwrap() error {
+	return e.Err
+}
+
+// Completes the request with its model, or the first of its fallback
+// models that works. Returns the name of the model used.
+func complete(ctx context.Context, c *gogpt.Client, request CompletionRequest) (string, string, Verdict, error) {
+	log := requestLogger(request)
+
+	chain := append([]string{request.Model}, request.FallbackModels...)
+	var lastErr error
+	for i, name := range chain {
+		// Make sure we have a valid model requested
+		m, err := Models.Get(name)
+		if err != nil {
+			log.Error("Requested invalid model", "model", name)
+			return "", "", Verdict{}, err
+		}
+		if i > 0 {
+			log.Warn("Falling back to the next model", "model", name, "err", lastErr)
+		}
+
+		// Past the budget there's no completion, and close
+		// to it a cheaper model may be used instead
+		planned, err := Spending.Plan(time.Now(), m, request.UserID)
+		if errors.Is(err, ErrOverBudget) {
+			budgetActions.WithLabelValues("refuse").Inc()
+			modelFallbacks.WithLabelValues(name, "budget").Inc()
+			log.Warn("Not completing, over budget", "model", name, "err", err)
+			lastErr = err
+			continue
+		}
+		if planned != m {
+			budgetActions.WithLabelValues("degrade").Inc()
+			log.Info("Close to budget, using a cheaper model", "model", name, "degraded_to", planned.Name)
+		}
+
+		text, verdict, err := completeWith(ctx, c, planned, request)
+		var modelErr *ModelError
+		if errors.As(err, &modelErr) && ctx.Err() == nil {
+			reason := "error"
+			if errors.Is(err, context.DeadlineExceeded) {
+				reason = "timeout"
 			}
+			modelFallbacks.WithLabelValues(planned.Name, reason).Inc()
+			lastErr = err
+			continue
+		}
+		return text, planned.Name, verdict, err
+	}
+	return "", "", Verdict{}, lastErr
+}
 
-			try := true
-			respText := ""
-			retries := 0
+func completeWith(ctx context.Context, c *gogpt.Client, m *Model, request CompletionRequest) (string, Verdict, error) {
+	log := requestLogger(request)
 
-			for try {
-				resp, err := c.CreateCompletion(ctx, request.Model.String(), req)
-				if err != nil {
-					return
-				}
+	prompt, messages, err := buildPrompt(m, request)
+	if err != nil {
+		return "", Verdict{}, err
+	}
 
-				respText = resp.Choices[0].Text
+	if request.Candidates <= 0 {
+		request.Candidates = Reranking.Candidates()
+	}
+	request.LogProbs = Reranking.UsesLogProbs()
 
-				sensitivity, err := checkSensitivity(respText, ctx, c)
-				check(err)
+	// Completion models carry on the conversation as whoever speaks
+	// next, unless they're stopped at the next speaker's label. Those
+	// go first so they're among the stops the API gets.
+	if m.Style == StyleCompletion {
+		request.Stop = mergeStops(speakerStops(promptSpeakers(prompt)), request.Stop)
+	}
+	if request.User == "" && request.UserID != 0 {
+		request.User = openAIUser(request.UserID)
+	}
+	if request.BestOf > 0 && request.BestOf < request.Candidates {
+		request.BestOf = request.Candidates
+	}
+
+	key := ""
+	if Cache.Enabled(request.templateName(), request.Temperature) {
+		key = cacheKey(m, request, prompt, messages)
+	} else if Cache != nil {
+		completionCacheLookups.WithLabelValues("bypass").Inc()
+	}
+
+	try := true
+	respText := ""
+	retries := 0
+	var verdict Verdict
+
+	model := m.Name
+
+	for try {
+		// A retry means the cached completion was flagged,
+		// so retries always go to the API
+		var candidates []Candidate
+		cached := false
+		if key != "" && retries == 0 {
+			candidates, cached = Cache.Get(key, time.Now())
+			if cached {
+				completionCacheLookups.WithLabelValues("hit").Inc()
+				log.Debug("Completion served from cache", "model", model)
+			} else {
+				completionCacheLookups.WithLabelValues("miss").Inc()
+			}
+		}
 
-				// Safe is 0, sensitive is 1, unsafe is 2
-				if sensitivity < 2 {
-					try = false
-				} else if retries >= MAX_COMPLETION_RETRIES {
-					respText = DEFAULT_RESPONSE
-					log.Printf("Max retries reached for prompt: %v", req.Prompt)
-					break
-				} else {
-					retries++
+		if !cached {
+			start := time.Now()
+			callCtx, call := tracer.Start(ctx, "openai.create_completion",
+				trace.WithAttributes(
+					attribute.String("model", model),
+					attribute.Int("retry", retries),
+					attribute.Int("candidates", request.Candidates),
+				))
+			callCtx, cancel := context.WithTimeout(callCtx, m.timeout())
+			var usage Usage
+			candidates, usage, err = callModel(callCtx, c, m, request, prompt, messages)
+			cancel()
+			endSpan(call, err)
+			completionLatency.WithLabelValues(model).Observe(time.Since(start).Seconds())
+			if err != nil {
+				completionErrors.WithLabelValues(model).Inc()
+				log.Error("Completion failed", "model", model, "err", err)
+				return "", verdict, &ModelError{Model: model, Err: err}
+			}
+			completionTokens.WithLabelValues(model, "prompt").Add(float64(usage.PromptTokens))
+			completionTokens.WithLabelValues(model, "completion").Add(float64(usage.CompletionTokens))
+
+			cost, err := Spending.Record(time.Now(), m, request.templateName(), request.UserID, usage)
+			if err != nil {
+				log.Warn("Couldn't save token usage", "err", err)
+			}
+			completionCost.WithLabelValues(model).Add(cost)
+			log.Info("Completion usage", "model", model, "template", request.templateName(),
+				"prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens,
+				"cost", cost)
+
+			if key != "" {
+				if err := Cache.Put(key, model, candidates, time.Now()); err != nil {
+					log.Warn("Couldn't save completion cache", "err", err)
 				}
 			}
+		}
+
+		// Only what would actually be posted is moderated and ranked
+		safe := []Candidate{}
+		verdicts := map[string]Verdict{}
+		empty := 0
+		for _, candidate := range candidates {
+			candidate.Text = PostProcessing.Process(filterResponse(candidate.Text, request.FilterRegex),
+				PostContext{Mentions: request.Mentions})
+			if candidate.Text == "" {
+				completionCandidates.WithLabelValues(model, "empty").Inc()
+				empty++
+				continue
+			}
+			v, err := Moderation.Check(ctx, "output", candidate.Text)
+			if err != nil {
+				log.Error("Moderation failed", "model", model, "err", err)
+				return "", v, err
+			}
+			if v.Flagged {
+				completionCandidates.WithLabelValues(model, "flagged").Inc()
+				verdict = v
+				continue
+			}
+			completionCandidates.WithLabelValues(model, "passed").Inc()
+			safe = append(safe, candidate)
+			verdicts[candidate.Text] = v
+		}
+		log.Debug("Moderated completion", "model", model, "candidates", len(candidates),
+			"passed", len(safe), "retries", retries)
+
+		if len(safe) > 0 {
+			ranked := Reranking.Rank(safe, RerankContext{
+				Lines:  request.Lines,
+				Recent: RecentPosts.List(),
+			})
+			best := ranked[0]
+			if len(ranked) > 1 {
+				log.Debug("Reranked candidates", "model", model,
+					"score", best.Score, "scores", best.Scores, "runner_up", ranked[1].Score)
+			}
+			respText, verdict = best.Text, verdicts[best.Text]
+			try = false
+		} else if empty == len(candidates) {
+			// The prompt gets nothing FilterRegex and post-processing
+			// leave anything of, retrying would only pay for more
+			respText, verdict = DEFAULT_RESPONSE, emptyVerdict()
+			defaultResponses.Inc()
+			log.Warn("Nothing left of the completion after post-processing, using default response",
+				"prompt", prompt)
+			break
+		} else if retries >= MAX_COMPLETION_RETRIES {
+			respText = DEFAULT_RESPONSE
+			defaultResponses.Inc()
+			log.Warn("Max retries reached, using default response",
+				"prompt", prompt)
+			break
+		} else {
+			retries++
+		}
+	}
+
+	sensitivityRetries.Observe(float64(retries))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("retries", retries))
+
+	return respText, verdict, nil
+}
+
+func (request CompletionRequest) templateName() string {
+	if request.TemplateName != "" {
+		return request.TemplateName
+	}
+	return request.Template.Name()
+}
+
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// One call to the model, whichever API it's behind. Returns
+// request.Candidates completions.
+func callModel(ctx context.Context, c *gogpt.Client, m *Model, request CompletionRequest,
+	prompt string, messages []ChatMessage) ([]Candidate, Usage, error) {
+	if streams(m, request) {
+		return streamModel(ctx, m, request, prompt, messages)
+	}
+
+	candidates := []Candidate{}
+	if m.Style == StyleChat {
+		resp, err := createChatCompletion(ctx, m.chatURL(), m.apiKey(), chatRequest{
+			Model:            m.ID,
+			Messages:         messages,
+			MaxTokens:        request.Tokens,
+			Temperature:      request.Temperature,
+			TopP:             request.TopP,
+			PresencePenalty:  request.PresencePenalty,
+			FrequencyPenalty: request.FrequencyPenalty,
+			LogitBias:        request.LogitBias,
+			User:             request.User,
+			Stop:             apiStops(request.Stop),
+			N:                request.Candidates,
+			Logprobs:         request.LogProbs,
+		})
+		if err != nil {
+			return nil, Usage{}, err
+		}
+		for _, choice := range resp.Choices {
+			candidates = append(candidates, Candidate{
+				Text:    cutAtStops(choice.Message.Content, request.Stop),
+				LogProb: meanLogProb(choice.Logprobs.values()),
+			})
+		}
+		return candidates, Usage{resp.Usage.PromptTokens, resp.Usage.CompletionTokens}, nil
+	}
+
+	// go-gpt3 has no user field, so User only reaches OpenAI
+	// for chat models and streamed completions
+	req := gogpt.CompletionRequest{
+		MaxTokens:        request.Tokens,
+		Prompt:           prompt,
+		Temperature:      request.Temperature,
+		TopP:             request.TopP,
+		PresencePenalty:  request.PresencePenalty,
+		FrequencyPenalty: request.FrequencyPenalty,
+		LogitBias:        request.LogitBias,
+		BestOf:           request.BestOf,
+		Stop:             apiStops(request.Stop),
+		N:                request.Candidates,
+	}
+	if request.LogProbs {
+		req.LogProbs = 1
+	}
+	resp, err := c.CreateCompletion(ctx, m.ID, req)
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, Usage{}, errors.New("Completion returned no choices")
+	}
+	for _, choice := range resp.Choices {
+		logprobs := []float64{}
+		for _, lp := range choice.LogProbs.TokenLogprobs {
+			logprobs = append(logprobs, float64(lp))
+		}
+		candidates = append(candidates, Candidate{
+			Text:    cutAtStops(choice.Text, request.Stop),
+			LogProb: meanLogProb(logprobs),
+		})
+	}
+	return candidates, Usage{resp.Usage.PromptTokens, resp.Usage.CompletionTokens}, nil
+}
 
-			filteredText := filterResponse(respText, request.FilterRegex)
+// Whether callModel streams. best_of can't be streamed, and the
+// go-gpt3 client only talks to OpenAI.
+func streams(m *Model, request CompletionRequest) bool {
+	if m.Style == StyleCompletion && m.BaseURL != "" {
+		return true
+	} else if m.Style == StyleCompletion && request.BestOf > 1 {
+		return false
+	}
+	return STREAM_COMPLETIONS
+}
 
-			request.ResponseChan <- CompletionResponse{
-				Response: filteredText,
-				Err:      nil,
+// Stops in order, without repeats
+func mergeStops(stops ...[]string) []string {
+	merged := []string{}
+	seen := map[string]bool{}
+	for _, list := range stops {
+		for _, stop := range list {
+			if !seen[stop] {
+				seen[stop] = true
+				merged = append(merged, stop)
 			}
 		}
-		close(request.ResponseChan)
+	}
+	return merged
+}
+
+// OpenAI only needs to tell users apart, not know who they are
+func openAIUser(userID int64) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(userID, 10)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Renders the request for the model's API style. If it doesn't fit in
+// the model's context, the oldest lines of the conversation are dropped.
+func buildPrompt(m *Model, request CompletionRequest) (string, []ChatMessage, error) {
+	lines := request.Lines
+	for {
+		prompt, messages, err := renderPrompt(m, request, lines)
+		if err != nil {
+			return "", nil, err
+		}
+
+		size := estimateTokens(prompt)
+		for _, message := range messages {
+			size += estimateTokens(message.Content)
+		}
+		if size+request.Tokens <= m.ContextLength || len(lines) <= 1 {
+			return prompt, messages, nil
+		}
+		lines = lines[1:]
 	}
 }
 
+func renderPrompt(m *Model, request CompletionRequest, lines []Line) (string, []ChatMessage, error) {
+	if m.Style == StyleChat {
+		if len(lines) == 0 {
+			lines = []Line{{IsJames: false, Text: request.Prompt}}
+		}
+		return "", chatMessages(request.System, lines), nil
+	}
+
+	if len(lines) == 0 {
+		return request.Prompt, nil, nil
+	} else if request.Template.Tree == nil {
+		return "", nil, errors.New("Request has lines but no template to render them with")
+	}
+	var buf bytes.Buffer
+	err := request.Template.Execute(&buf, lines)
+	return buf.String(), nil, err
+}
+
 func filterResponse(text string, regex string) string {
 	// Regex to match the beginning of text we want to remove
 	// If the ai tries to provide the user's response to it's response,
-	// we'll remove it
+	// we'll remove it. No regex means nothing is removed.
+	if regex == "" {
+		return text
+	}
 	re := regexp.MustCompile(regex)
 	indexes := re.FindStringIndex(text)
 
@@ -146,10 +616,18 @@ func checkSensitivity(text string, ctx context.Context, c *gogpt.Client) (int, e
 	}
 
 	resp, err := c.CreateCompletion(ctx, "content-filter-alpha-c4", req)
-	check(err)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Choices) == 0 {
+		return 0, errors.New("Content filter returned no choices")
+	}
 
-	sensitivity, err := strconv.Atoi(resp.Choices[0].Text)
-	check(err)
+	sensitivity, err := strconv.Atoi(strings.TrimSpace(resp.Choices[0].Text))
+	if err != nil {
+		return 0, fmt.Errorf("Content filter returned a label that isn't a number: %q",
+			resp.Choices[0].Text)
+	}
 
 	return sensitivity, nil
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Used when the config has no post_processing section
+var DEFAULT_POST_PROCESSING = &PostProcessConfig{
+	Steps:       []string{"urls", "mentions", "hashtags", "emoji", "profanity", "sentences", "trim"},
+	MaxHashtags: 0,
+	MaxEmoji:    2,
+}
+
+// Masked by "profanity" when the config doesn't list any words.
+// Words starting with these are masked too, i.e. "shitty".
+var DEFAULT_PROFANITY = []string{
+	"fuck", "shit", "bitch", "bastard", "asshole", "cunt", "dick", "piss", "crap", "damn",
+}
+
+// Cleans up every completion before it's moderated and posted, after
+// FilterRegex has cut it.
+//
+//	"post_processing": {
+//	  "steps": ["urls", "mentions", "hashtags", "emoji", "profanity", "sentences", "trim"],
+//	  "allowed_mentions": ["LiamTestAccoun3"],
+//	  "max_hashtags": 1,
+//	  "max_emoji": 0,
+//	  "profanity": ["heck"]
+//	}
+type PostProcessConfig struct {
+	// Run in this order. Any of "trim", "sentences", "mentions",
+	// "hashtags", "emoji", "profanity" and "urls".
+	Steps []string `json:"steps"`
+	// Screen names "mentions" leaves alone, on top of the
+	// user the completion is for
+	AllowedMentions []string `json:"allowed_mentions"`
+	// The first this many are kept, the rest removed
+	MaxHashtags int `json:"max_hashtags"`
+	MaxEmoji    int `json:"max_emoji"`
+	// Words "profanity" masks, defaults to DEFAULT_PROFANITY
+	Profanity []string `json:"profanity"`
+}
+
+// What a post-processor knows about the completion
+type PostContext struct {
+	// Screen names the completion is allowed to mention,
+	// i.e. the user being replied to
+	Mentions []string
+}
+
+// A PostProcessor rewrites a completion, one thing at a time
+type PostProcessor interface {
+	Name() string
+	Process(text string, pc PostContext) string
+}
+
+type PostProcessChain struct {
+	processors []PostProcessor
+}
+
+// Set in main. A nil chain leaves completions as they are.
+var PostProcessing *PostProcessChain
+
+// What a completion FilterRegex and post-processing left nothing of
+// counts as. It's flagged, so callers resolve it through the fallback
+// pool the same way as one moderation kept flagging.
+func emptyVerdict() Verdict {
+	return Verdict{
+		Stage:     "output",
+		Flagged:   true,
+		Moderator: "post_processing",
+		Category:  "empty",
+		Reason:    "nothing left to post after post-processing",
+		Time:      time.Now(),
+	}
+}
+
+func newPostProcessChain(c *PostProcessConfig) (*PostProcessChain, error) {
+	if c.MaxHashtags < 0 || c.MaxEmoji < 0 {
+		return nil, fmt.Errorf("Post processing limits can't be negative")
+	}
+
+	chain := &PostProcessChain{}
+	for _, step := range c.Steps {
+		var p PostProcessor
+		switch step {
+		case "trim":
+			p = &TrimProcessor{}
+		case "sentences":
+			p = &SentenceProcessor{}
+		case "mentions":
+			p = &MentionProcessor{Allowed: c.AllowedMentions}
+		case "hashtags":
+			p = &HashtagProcessor{Max: c.MaxHashtags}
+		case "emoji":
+			p = &EmojiProcessor{Max: c.MaxEmoji}
+		case "profanity":
+			words := c.Profanity
+			if len(words) == 0 {
+				words = DEFAULT_PROFANITY
+			}
+			p = newProfanityProcessor(words)
+		case "urls":
+			p = &URLProcessor{}
+		default:
+			return nil, fmt.Errorf("Unknown post processing step %q", step)
+		}
+		chain.processors = append(chain.processors, p)
+	}
+	return chain, nil
+}
+
+func (chain *PostProcessChain) Process(text string, pc PostContext) string {
+	if chain == nil {
+		return text
+	}
+	for _, p := range chain.processors {
+		processed := p.Process(text, pc)
+		if processed != text {
+			postProcessChanges.WithLabelValues(p.Name()).Inc()
+		}
+		text = processed
+	}
+	return text
+}
+
+var (
+	extraSpaces      = regexp.MustCompile(`[ \t]+`)
+	spaceBeforePunct = regexp.MustCompile(`[ \t]+([.,!?;:])`)
+	sentenceEnd      = regexp.MustCompile(`[.!?…]+["'”’)]*(\s|$)`)
+	endsWithSentence = regexp.MustCompile(`[.!?…]+["'”’)]*$`)
+	mentionPattern   = regexp.MustCompile(`(^|[^\w@])@(\w{1,15})\b`)
+	hashtagPattern   = regexp.MustCompile(`(^|[^\w&])#(\w+)`)
+	urlPattern       = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+)
+
+// Zero width joiner and the variation selector that makes
+// the character before it an emoji
+const (
+	zeroWidthJoiner   = '\u200d'
+	variationSelector = '\ufe0f'
+)
+
+// Whatever removing words left behind
+func tidy(text string) string {
+	text = extraSpaces.ReplaceAllString(text, " ")
+	text = spaceBeforePunct.ReplaceAllString(text, "$1")
+	return strings.TrimSpace(text)
+}
+
+// Drops leading and trailing whitespace, and turns runs of spaces
+// and tabs into single spaces
+type TrimProcessor struct{}
+
+func (p *TrimProcessor) Name() string { return "trim" }
+
+func (p *TrimProcessor) Process(text string, pc PostContext) string {
+	return strings.TrimSpace(extraSpaces.ReplaceAllString(text, " "))
+}
+
+// Cuts a dangling half sentence off the end, which is what running
+// out of tokens leaves. Text without a full sentence is left alone.
+type SentenceProcessor struct{}
+
+func (p *SentenceProcessor) Name() string { return "sentences" }
+
+func (p *SentenceProcessor) Process(text string, pc PostContext) string {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if trimmed == "" || endsWithSentence.MatchString(trimmed) {
+		return trimmed
+	}
+	if last, _ := utf8.DecodeLastRuneInString(trimmed); isEmoji(last) {
+		return trimmed
+	}
+
+	ends := sentenceEnd.FindAllStringIndex(trimmed, -1)
+	if len(ends) == 0 {
+		return trimmed
+	}
+	return strings.TrimRightFunc(trimmed[:ends[len(ends)-1][1]], unicode.IsSpace)
+}
+
+// Removes @mentions of anyone but the user the completion is for and
+// the allowed ones, completion models like to tag random accounts
+type MentionProcessor struct {
+	Allowed []string
+}
+
+func (p *MentionProcessor) Name() string { return "mentions" }
+
+func (p *MentionProcessor) Process(text string, pc PostContext) string {
+	allowed := map[string]bool{}
+	for _, name := range append(append([]string{}, p.Allowed...), pc.Mentions...) {
+		allowed[strings.ToLower(strings.TrimPrefix(name, "@"))] = true
+	}
+
+	processed := mentionPattern.ReplaceAllStringFunc(text, func(match string) string {
+		parts := mentionPattern.FindStringSubmatch(match)
+		if allowed[strings.ToLower(parts[2])] {
+			return match
+		}
+		return parts[1]
+	})
+	if processed == text {
+		return text
+	}
+	return tidy(processed)
+}
+
+// Keeps the first Max hashtags and removes the rest
+type HashtagProcessor struct {
+	Max int
+}
+
+func (p *HashtagProcessor) Name() string { return "hashtags" }
+
+func (p *HashtagProcessor) Process(text string, pc PostContext) string {
+	seen := 0
+	processed := hashtagPattern.ReplaceAllStringFunc(text, func(match string) string {
+		seen++
+		if seen <= p.Max {
+			return match
+		}
+		return hashtagPattern.FindStringSubmatch(match)[1]
+	})
+	if processed == text {
+		return text
+	}
+	return tidy(processed)
+}
+
+// Keeps the first Max emoji and removes the rest
+type EmojiProcessor struct {
+	Max int
+}
+
+func (p *EmojiProcessor) Name() string { return "emoji" }
+
+func (p *EmojiProcessor) Process(text string, pc PostContext) string {
+	var b strings.Builder
+	seen := 0
+	dropping := false
+	for _, r := range text {
+		switch {
+		case isEmoji(r):
+			// Skin tones are part of the emoji before them
+			if r >= 0x1F3FB && r <= 0x1F3FF {
+				if !dropping {
+					b.WriteRune(r)
+				}
+				continue
+			}
+			seen++
+			dropping = seen > p.Max
+			if !dropping {
+				b.WriteRune(r)
+			}
+		case r == zeroWidthJoiner || r == variationSelector:
+			// Joined emoji like 👨‍👩‍👧 count as one
+			if !dropping {
+				b.WriteRune(r)
+			}
+			if r == zeroWidthJoiner {
+				seen--
+			}
+		default:
+			dropping = false
+			b.WriteRune(r)
+		}
+	}
+	if b.String() == text {
+		return text
+	}
+	return tidy(b.String())
+}
+
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF) ||
+		(r >= 0x2B00 && r <= 0x2BFF)
+}
+
+// Masks profanity, keeping the first letter: "s***"
+type ProfanityProcessor struct {
+	re *regexp.Regexp
+}
+
+func newProfanityProcessor(words []string) *ProfanityProcessor {
+	quoted := []string{}
+	for _, w := range words {
+		quoted = append(quoted, regexp.QuoteMeta(w))
+	}
+	return &ProfanityProcessor{
+		re: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)[\w']*`),
+	}
+}
+
+func (p *ProfanityProcessor) Name() string { return "profanity" }
+
+func (p *ProfanityProcessor) Process(text string, pc PostContext) string {
+	return p.re.ReplaceAllStringFunc(text, func(word string) string {
+		first, size := utf8.DecodeRuneInString(word)
+		return string(first) + strings.Repeat("*", utf8.RuneCountInString(word[size:]))
+	})
+}
+
+// Removes links, which are made up more often than not
+type URLProcessor struct{}
+
+func (p *URLProcessor) Name() string { return "urls" }
+
+func (p *URLProcessor) Process(text string, pc PostContext) string {
+	processed := urlPattern.ReplaceAllString(text, "")
+	if processed == text {
+		return text
+	}
+	return tidy(processed)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Where a scheduled post goes
+type PostTarget string
+
+const (
+	// A plain tweet on James's timeline
+	TargetTimeline PostTarget = "timeline"
+	// A reply to the latest tweet of each user, or a mention if they
+	// have none
+	TargetReply PostTarget = "reply"
+	// A direct message to each user
+	TargetDM PostTarget = "dm"
+)
+
+// A completion that's posted on a schedule, defined in the config
+type ScheduledPost struct {
+	Name     string        `json:"name"`
+	Schedule string        `json:"schedule"`
+	TimeZone string        `json:"time_zone"`
+	Jitter   Duration      `json:"jitter"`
+	CatchUp  CatchUpPolicy `json:"catch_up"`
+
+	// Prompt as a text/template, executed with PostData
+	Template string `json:"template"`
+	Model    string `json:"model"`
+	// Temperature, top_p and so on, right in the post
+	Sampling
+	// Defaults to MAX_TWEET_TOKENS
+	Tokens      int    `json:"tokens"`
+	FilterRegex string `json:"filter_regex"`
+	// Tried in order when Model fails
+	FallbackModels []string `json:"fallback_models"`
+	// Completions to pick the best from, defaults to the
+	// candidates in the rerank config
+	Candidates int `json:"candidates"`
+
+	Target PostTarget `json:"target"`
+	// Screen names the post is written for, one completion each.
+	// Replies and DMs need either these or subscribers. Without
+	// any, a single post is made for nobody in particular.
+	Users []string `json:"users"`
+
+	// Topic users subscribe to by tweeting "subscribe <topic>" at
+	// James. The post is then made for every subscriber, replying or
+	// DMing them as they asked.
+	Subscribers string `json:"subscribers"`
+	// Most subscribers posted for in a day, 0 means no limit.
+	// Whoever doesn't fit gets theirs first the next day.
+	MaxPerDay int `json:"max_per_day"`
+
+	// Fallback responses in the voice of this post, instead of
+	// the global ones
+	Fallback *FallbackConfig `json:"fallback"`
+
+	tmpl      *template.Template
+	fallbacks *FallbackPool
+}
+
+// What a scheduled post's template gets to work with
+type PostData struct {
+	// Zero, apart from ScreenName, if the post has no users
+	User User
+	// Star sign the subscriber gave, if any
+	Sign string
+	// When the post is made, in the post's time zone
+	Date time.Time
+}
+
+// The daily horoscope for everyone who subscribed, used when
+// the config doesn't define any scheduled posts
+var DEFAULT_SCHEDULED_POSTS = []*ScheduledPost{
+	{
+		Name:        "horoscope",
+		Subscribers: "horoscope",
+		MaxPerDay:   100,
+		Schedule:    "0 8 * * *",
+		TimeZone:    "America/Los_Angeles",
+		Jitter:      Duration(5 * time.Minute),
+		CatchUp:     CatchUpOnce,
+		Template:    HoroscopeTmpl,
+		Model:       GPT35TurboInstruct,
+		Sampling:    Sampling{Temperature: 0.9},
+		FilterRegex: `\n`,
+		Target:      TargetReply,
+	},
+}
+
+// Scheduled posts by name, so they can also be run through the admin API.
+// Set in main.
+var SCHEDULED_POSTS = map[string]*ScheduledPost{}
+
+// Checks the post against the models it can use, and parses its template
+func (p *ScheduledPost) compile(models *ModelRegistry) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Scheduled post %q: %w", p.Name, err)
+		}
+	}()
+
+	if p.Name == "" {
+		return errors.New("Scheduled post needs a name")
+	}
+	if len(p.Users) > 0 && p.Subscribers != "" {
+		return errors.New("Scheduled post can't have both users and subscribers")
+	}
+	for _, name := range append([]string{p.Model}, p.FallbackModels...) {
+		if _, err = models.Get(name); err != nil {
+			return err
+		}
+	}
+	if p.tmpl, err = template.New(p.Name).Parse(p.Template); err != nil {
+		return err
+	}
+	if _, err := regexp.Compile(p.FilterRegex); err != nil {
+		return err
+	}
+	if err := p.Sampling.validate(); err != nil {
+		return err
+	}
+	if p.Fallback != nil {
+		if p.fallbacks, err = newFallbackPool(p.Fallback); err != nil {
+			return err
+		}
+	}
+	if p.CatchUp == "" {
+		p.CatchUp = CatchUpSkip
+	} else if p.CatchUp != CatchUpSkip && p.CatchUp != CatchUpOnce {
+		return fmt.Errorf("Unknown catch up policy %q", p.CatchUp)
+	}
+
+	switch p.Target {
+	case TargetTimeline:
+		if p.Subscribers != "" {
+			return errors.New("Posts for subscribers can't go on the timeline")
+		}
+	case TargetReply, TargetDM:
+		if len(p.Users) == 0 && p.Subscribers == "" {
+			return fmt.Errorf("Target %q needs users or subscribers", p.Target)
+		}
+	default:
+		return fmt.Errorf("Unknown target %q", p.Target)
+	}
+	return nil
+}
+
+func (p *ScheduledPost) job() (*Job, error) {
+	job := &Job{
+		Name:     p.Name,
+		Schedule: p.Schedule,
+		TimeZone: p.TimeZone,
+		Jitter:   time.Duration(p.Jitter),
+		CatchUp:  p.CatchUp,
+		Run:      p.run,
+	}
+	_, err := parseJobSchedule(job)
+	return job, err
+}
+
+func (p *ScheduledPost) prompt(data PostData) (string, error) {
+	var buf bytes.Buffer
+	err := p.tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// Makes the post once for every user or subscriber. A user that fails
+// doesn't stop the others, all the errors are returned together.
+func (p *ScheduledPost) run(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "james.scheduled_post")
+	defer func() { endSpan(span, err) }()
+
+	logger(ctx).Info("Making scheduled post", "post", p.Name, "target", p.Target)
+
+	now := time.Now()
+	if loc, err := time.LoadLocation(p.TimeZone); err == nil {
+		now = now.In(loc)
+	}
+
+	if p.Subscribers != "" {
+		return p.runForSubscribers(ctx, now)
+	} else if len(p.Users) == 0 {
+		return p.post(ctx, p.Target, PostData{Date: now}, nil)
+	}
+
+	errs := []error{}
+	for _, screenName := range p.Users {
+		data := PostData{User: User{ScreenName: screenName}, Date: now}
+		if err := p.postFor(ctx, p.Target, data); err != nil {
+			errs = append(errs, fmt.Errorf("@%v: %w", screenName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Subscribers already posted for today are skipped, so running the
+// post again (from the admin API, or catching up) never doubles up
+func (p *ScheduledPost) runForSubscribers(ctx context.Context, now time.Time) error {
+	sentToday := 0
+	pending := []Subscription{}
+	for _, sub := range Subscriptions.List(p.Subscribers) {
+		if sameDay(sub.LastSent.In(now.Location()), now) {
+			sentToday++
+		} else {
+			pending = append(pending, sub)
+		}
+	}
+
+	errs := []error{}
+	for i, sub := range pending {
+		if p.MaxPerDay > 0 && sentToday >= p.MaxPerDay {
+			logger(ctx).Warn("Scheduled post hit its daily budget", "post", p.Name,
+				"max_per_day", p.MaxPerDay, "skipped", len(pending)-i)
+			break
+		}
+
+		target := p.Target
+		if sub.DM {
+			target = TargetDM
+		}
+		data := PostData{User: sub.User, Sign: sub.Sign, Date: now}
+		if err := p.postFor(ctx, target, data); err != nil {
+			errs = append(errs, fmt.Errorf("@%v: %w", sub.User.ScreenName, err))
+			continue
+		}
+
+		sentToday++
+		if err := Subscriptions.MarkSent(p.Subscribers, sub.User.ID, time.Now()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// Looks the user up if the target needs more than we know about
+// them, then makes the post for them
+func (p *ScheduledPost) postFor(ctx context.Context, target PostTarget, data PostData) error {
+	var profile *Profile
+	if target == TargetReply || (target == TargetDM && data.User.ID == 0) {
+		found, err := Twitter.ShowUser(ctx, data.User)
+		if err != nil {
+			return err
+		}
+		profile = &found
+		data.User = found.User
+	}
+	return p.post(ctx, target, data, profile)
+}
+
+func (p *ScheduledPost) post(ctx context.Context, target PostTarget, data PostData, profile *Profile) error {
+	log := logger(ctx).With("post", p.Name, "screen_name", data.User.ScreenName)
+
+	prompt, err := p.prompt(data)
+	if err != nil {
+		return err
+	}
+
+	tokens := p.Tokens
+	if tokens == 0 {
+		tokens = MAX_TWEET_TOKENS
+	}
+
+	responseChan := make(chan CompletionResponse, 1)
+	req := CompletionRequest{
+		Prompt:         prompt,
+		FilterRegex:    p.FilterRegex,
+		ResponseChan:   responseChan,
+		Model:          p.Model,
+		FallbackModels: p.FallbackModels,
+		Tokens:         tokens,
+		Candidates:     p.Candidates,
+		TemplateName:   p.Name,
+		UserID:         data.User.ID,
+		Mentions:       []string{data.User.ScreenName},
+		CorrelationID:  correlationID(ctx),
+		Context:        ctx,
+		Enqueued:       time.Now(),
+	}
+	p.Sampling.apply(&req)
+	JamesBuffer <- req
+
+	resp := <-responseChan
+	if resp.Err != nil {
+		return resp.Err
+	}
+	log.Debug("Scheduled post completed", "model", resp.Model)
+
+	var inReplyTo int64
+	if target == TargetReply && profile.Status != nil {
+		inReplyTo = profile.Status.ID
+	}
+
+	// Moderation flagged every try, or post-processing left nothing
+	// of the completion, so the response is only DEFAULT_RESPONSE
+	text := strings.TrimSpace(resp.Response)
+	if resp.Verdict.Flagged {
+		var ok bool
+		text, ok, err = p.fallback(target).Resolve(ctx, p.Name, inReplyTo, data.User, resp.Verdict)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	switch target {
+	case TargetDM:
+		err := Twitter.SendDirectMessage(ctx, data.User.ID, text)
+		recordDirectMessage(p.Name, err)
+		if err != nil {
+			return err
+		}
+		log.Info("Sent scheduled post as DM", "response", text)
+		return nil
+
+	case TargetReply:
+		// Replies have to mention the user to show up in their thread
+		mention := "@" + profile.ScreenName
+		if !strings.Contains(text, mention) {
+			text = mention + " " + text
+		}
+		return p.tweet(ctx, text, inReplyTo)
+
+	default:
+		return p.tweet(ctx, text, 0)
+	}
+}
+
+// Approving a DM would tweet it for everyone to see,
+// so DMs go unsent instead
+var silentFallback = &FallbackPool{action: "silent"}
+
+func (p *ScheduledPost) fallback(target PostTarget) *FallbackPool {
+	pool := p.fallbacks
+	if pool == nil {
+		pool = Fallbacks
+	}
+	if target == TargetDM && pool != nil && pool.Action() == "approval" {
+		return silentFallback
+	}
+	return pool
+}
+
+func (p *ScheduledPost) tweet(ctx context.Context, text string, inReplyTo int64) error {
+	posted, err := Twitter.PostStatus(ctx, text, inReplyTo)
+	recordTweetPost(p.Name, posted, err)
+	if IsDuplicateStatus(err) {
+		logger(ctx).Warn("Twitter rejected scheduled post as a duplicate",
+			"post", p.Name, "response", text)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	logger(ctx).Info("Tweeted scheduled post", "post", p.Name,
+		"response", text, "tweet_id", posted.ID)
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of requests we keep in reserve per endpoint family. Once an
+// endpoint is down to this many, calls wait for the window to reset.
+var RATE_LIMIT_RESERVE int = 1
+
+// Longest we're willing to block a call waiting on a rate limit.
+// Windows are 15 minutes, so anything longer means something is wrong.
+var MAX_RATE_LIMIT_WAIT time.Duration = 16 * time.Minute
+
+// Longest a webhook event waits on a rate limit. Twitter gives up on
+// a delivery after a few seconds and sends it again, so past this the
+// event is dropped instead.
+var WEBHOOK_MAX_RATE_LIMIT_WAIT time.Duration = 3 * time.Second
+
+// Added to every wait in case our clock is ahead of Twitter's
+var RATE_LIMIT_CLOCK_SLACK time.Duration = time.Second
+
+// How many times a call that got a 429 is retried after waiting
+var MAX_RATE_LIMIT_RETRIES int = 2
+
+// Used when Twitter sends a 429 without telling us when the window resets
+var DEFAULT_RATE_LIMIT_BACKOFF time.Duration = time.Minute
+
+var ErrRateLimited = errors.New("Twitter rate limit exceeded")
+
+type maxRateLimitWaitKey struct{}
+
+// Calls made with the returned context wait at most max on a rate
+// limit, and return ErrRateLimited if it resets later than that
+func withMaxRateLimitWait(ctx context.Context, max time.Duration) context.Context {
+	return context.WithValue(ctx, maxRateLimitWaitKey{}, max)
+}
+
+func maxRateLimitWait(ctx context.Context) time.Duration {
+	if max, ok := ctx.Value(maxRateLimitWaitKey{}).(time.Duration); ok && max < MAX_RATE_LIMIT_WAIT {
+		return max
+	}
+	return MAX_RATE_LIMIT_WAIT
+}
+
+type rateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// RateLimiter tracks the x-rate-limit-* headers Twitter sends back,
+// per endpoint family (i.e. "statuses_show"), and delays calls that
+// would go over.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limits map[string]*rateLimit
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{limits: map[string]*rateLimit{}}
+}
+
+// Blocks until a call to family is allowed, or returns an error if
+// that would take longer than MAX_RATE_LIMIT_WAIT (or the max set
+// with withMaxRateLimitWait) or ctx is done.
+func (rl *RateLimiter) Wait(ctx context.Context, family string) error {
+	for {
+		rl.mu.Lock()
+		l, ok := rl.limits[family]
+		if !ok || time.Now().After(l.Reset) || l.Remaining > RATE_LIMIT_RESERVE {
+			// Count the call now so concurrent callers don't
+			// all see the same remaining budget
+			if ok && l.Remaining > 0 {
+				l.Remaining--
+			}
+			rl.mu.Unlock()
+			return nil
+		}
+		reset := l.Reset
+		rl.mu.Unlock()
+
+		if err := sleepUntil(ctx, family, reset); err != nil {
+			return err
+		}
+	}
+}
+
+// Update records the rate limit headers of a response
+func (rl *RateLimiter) Update(family string, resp *http.Response) {
+	limit, errLimit := strconv.Atoi(resp.Header.Get("x-rate-limit-limit"))
+	remaining, errRemaining := strconv.Atoi(resp.Header.Get("x-rate-limit-remaining"))
+	reset, errReset := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64)
+
+	// Not every endpoint sends these, i.e. statuses/update
+	if errLimit != nil || errRemaining != nil || errReset != nil {
+		return
+	}
+
+	rl.mu.Lock()
+	rl.limits[family] = &rateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Unix(reset, 0),
+	}
+	rl.mu.Unlock()
+
+	twitterRateLimitRemaining.WithLabelValues(family).Set(float64(remaining))
+	slog.Debug("Twitter rate limit", "endpoint", family,
+		"remaining", remaining, "limit", limit, "reset", time.Unix(reset, 0))
+}
+
+// Called when a request got a 429. Returns when the call can be retried.
+func (rl *RateLimiter) Backoff(ctx context.Context, family string, resp *http.Response) error {
+	twitterRateLimited.WithLabelValues(family).Inc()
+
+	reset := time.Now().Add(DEFAULT_RATE_LIMIT_BACKOFF)
+	if r, err := strconv.ParseInt(resp.Header.Get("x-rate-limit-reset"), 10, 64); err == nil {
+		reset = time.Unix(r, 0)
+	}
+
+	rl.mu.Lock()
+	rl.limits[family] = &rateLimit{Remaining: 0, Reset: reset}
+	rl.mu.Unlock()
+
+	return sleepUntil(ctx, family, reset)
+}
+
+func sleepUntil(ctx context.Context, family string, reset time.Time) error {
+	wait := time.Until(reset) + RATE_LIMIT_CLOCK_SLACK
+	if wait > maxRateLimitWait(ctx) {
+		return fmt.Errorf("%w: %v resets in %v", ErrRateLimited, family, wait.Round(time.Second))
+	}
+
+	logger(ctx).Warn("Waiting for Twitter rate limit to reset",
+		"endpoint", family, "wait", wait.String())
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Used when the config has no reply_limits section
+var DEFAULT_REPLY_LIMITS = &ReplyLimitsConfig{
+	User:           BucketConfig{Burst: 5, Every: Duration(10 * time.Minute)},
+	Global:         BucketConfig{Burst: 60, Every: Duration(30 * time.Second)},
+	ThreadCooldown: Duration(10 * time.Second),
+	MaxThreadDepth: 30,
+	LoopReplies:    4,
+	LoopWindow:     Duration(30 * time.Second),
+	LoopMute:       Duration(6 * time.Hour),
+}
+
+// Users we haven't heard from in this long are forgotten,
+// their buckets would be full again anyway
+var REPLY_LIMITS_IDLE time.Duration = 24 * time.Hour
+
+// How often James replies, so a single user (or another bot
+// mentioning James back every time he answers) can't make him
+// reply forever.
+//
+//	"reply_limits": {
+//	  "user": {"burst": 5, "every": "10m"},
+//	  "global": {"burst": 60, "every": "30s"},
+//	  "thread_cooldown": "10s",
+//	  "max_thread_depth": 30,
+//	  "loop_replies": 4,
+//	  "loop_window": "30s",
+//	  "loop_mute": "6h"
+//	}
+type ReplyLimitsConfig struct {
+	// Replies to each user, and to everyone together
+	User   BucketConfig `json:"user"`
+	Global BucketConfig `json:"global"`
+	// Least time between two replies in the same thread
+	ThreadCooldown Duration `json:"thread_cooldown"`
+	// Threads with more tweets than this don't get replies, 0
+	// means no limit
+	MaxThreadDepth int `json:"max_thread_depth"`
+
+	// A user who answers James within LoopWindow of his reply
+	// LoopReplies times in a row is most likely a bot, and is
+	// ignored for LoopMute. 0 turns loop detection off.
+	LoopReplies int      `json:"loop_replies"`
+	LoopWindow  Duration `json:"loop_window"`
+	LoopMute    Duration `json:"loop_mute"`
+}
+
+// A token bucket that holds Burst replies and gets one back
+// every Every. A Burst of 0 means no limit.
+type BucketConfig struct {
+	Burst int      `json:"burst"`
+	Every Duration `json:"every"`
+}
+
+func (c *ReplyLimitsConfig) validate() error {
+	for _, b := range []BucketConfig{c.User, c.Global} {
+		if b.Burst < 0 {
+			return errors.New("Reply limit burst can't be negative")
+		}
+		if b.Burst > 0 && b.Every <= 0 {
+			return errors.New("Reply limit with a burst needs every")
+		}
+	}
+	if c.MaxThreadDepth < 0 || c.LoopReplies < 0 {
+		return errors.New("Reply limits can't be negative")
+	}
+	if c.LoopReplies > 0 && (c.LoopWindow <= 0 || c.LoopMute <= 0) {
+		return errors.New("Reply loop detection needs loop_window and loop_mute")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refills the bucket for the time since it was last used,
+// then takes a token if there is one
+func (b *tokenBucket) take(c BucketConfig, now time.Time) bool {
+	if c.Burst == 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(c.Burst)
+	} else {
+		refilled := float64(now.Sub(b.last)) / float64(c.Every)
+		b.tokens = math.Min(float64(c.Burst), b.tokens+refilled)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type userLimits struct {
+	bucket tokenBucket
+	// When James last replied to them
+	lastReply time.Time
+	// Times in a row they answered within LoopWindow
+	quickAnswers int
+	mutedUntil   time.Time
+	lastSeen     time.Time
+}
+
+type ReplyLimiter struct {
+	mu     sync.Mutex
+	config ReplyLimitsConfig
+	global tokenBucket
+	users  map[int64]*userLimits
+	// Root tweet ID of a thread to when James last replied in it
+	threads   map[int64]time.Time
+	lastPrune time.Time
+}
+
+// Set in main. A nil limiter lets every reply through.
+var ReplyLimits *ReplyLimiter
+
+func newReplyLimiter(c *ReplyLimitsConfig) *ReplyLimiter {
+	return &ReplyLimiter{
+		config:  *c,
+		users:   map[int64]*userLimits{},
+		threads: map[int64]time.Time{},
+	}
+}
+
+// Decides if a tweet from the user gets a reply at all. If not,
+// returns the reason, which is also what eventsFiltered counts it as.
+func (rl *ReplyLimiter) Allow(userID int64, now time.Time) (string, bool) {
+	if rl == nil {
+		return "", true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.prune(now)
+	u, ok := rl.users[userID]
+	if !ok {
+		u = &userLimits{}
+		rl.users[userID] = u
+	}
+	u.lastSeen = now
+
+	if c := rl.config; c.LoopReplies > 0 && !u.lastReply.IsZero() {
+		if now.Sub(u.lastReply) <= time.Duration(c.LoopWindow) {
+			u.quickAnswers++
+		} else {
+			u.quickAnswers = 0
+		}
+		if u.quickAnswers >= c.LoopReplies {
+			u.mutedUntil = now.Add(time.Duration(c.LoopMute))
+			u.quickAnswers = 0
+			replyLoopsDetected.Inc()
+		}
+	}
+	if now.Before(u.mutedUntil) {
+		return "reply_loop", false
+	}
+
+	if !u.bucket.take(rl.config.User, now) {
+		return "user_quota", false
+	}
+	if !rl.global.take(rl.config.Global, now) {
+		return "global_quota", false
+	}
+	return "", true
+}
+
+// Decides if James replies in a thread, given its root tweet and how
+// many tweets it has. Same as Allow otherwise.
+func (rl *ReplyLimiter) AllowThread(root int64, depth int, now time.Time) (string, bool) {
+	if rl == nil {
+		return "", true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.config.MaxThreadDepth > 0 && depth > rl.config.MaxThreadDepth {
+		return "thread_depth", false
+	}
+	if last, ok := rl.threads[root]; ok && now.Sub(last) < time.Duration(rl.config.ThreadCooldown) {
+		return "thread_cooldown", false
+	}
+	return "", true
+}
+
+// Past this many tweets there's no point unrolling a thread,
+// 0 if there's no limit
+func (rl *ReplyLimiter) MaxThreadDepth() int {
+	if rl == nil {
+		return 0
+	}
+	return rl.config.MaxThreadDepth
+}
+
+// Records a reply James posted, for the thread cooldown and
+// loop detection
+func (rl *ReplyLimiter) Replied(userID int64, root int64, now time.Time) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.threads[root] = now
+	if u, ok := rl.users[userID]; ok {
+		u.lastReply = now
+	}
+}
+
+// Forgets users and threads nothing happened in for a while
+func (rl *ReplyLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	for id, u := range rl.users {
+		if now.Sub(u.lastSeen) > REPLY_LIMITS_IDLE && now.After(u.mutedUntil) {
+			delete(rl.users, id)
+		}
+	}
+	for root, last := range rl.threads {
+		if now.Sub(last) > time.Duration(rl.config.ThreadCooldown) {
+			delete(rl.threads, root)
+		}
+	}
+}
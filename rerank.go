@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Used when the config has no rerank section. One candidate
+// means there's nothing to rank.
+var DEFAULT_RERANK = &RerankConfig{
+	Candidates: 1,
+	Scorers:    map[string]float64{"length": 1, "repetition": 1, "duplicate": 1},
+}
+
+// Number of James's own tweets new candidates are compared against
+var MAX_RECENT_POSTS int = 50
+
+// Candidates shorter than this read like one word answers
+var MIN_CANDIDATE_CHARS int = 40
+
+// Instead of making one completion and retrying while moderation flags
+// it, several candidates are made in one call. The flagged ones are
+// dropped and the best of the rest is posted.
+//
+//	"rerank": {
+//	  "candidates": 4,
+//	  "scorers": {"length": 1, "repetition": 2, "duplicate": 2, "logprob": 0.5}
+//	}
+type RerankConfig struct {
+	// Completions asked for in each call, requests can ask for more
+	Candidates int `json:"candidates"`
+	// Weight of each scorer, any of "length", "repetition",
+	// "duplicate" and "logprob". "logprob" makes the API send log
+	// probabilities, which costs a little more.
+	Scorers map[string]float64 `json:"scorers"`
+}
+
+// One of the completions of a call
+type Candidate struct {
+	Text string `json:"text"`
+	// Mean log probability of the tokens, nil unless asked for
+	LogProb *float64 `json:"log_prob,omitempty"`
+}
+
+// What candidates are compared against
+type RerankContext struct {
+	// The conversation being replied to, if any
+	Lines []Line
+	// James's latest tweets, oldest first
+	Recent []string
+}
+
+// A Scorer rates a candidate from 0 (bad) to 1 (good)
+type Scorer interface {
+	Name() string
+	Score(c Candidate, rc RerankContext) float64
+}
+
+type ScoredCandidate struct {
+	Candidate
+	// Weighted sum of Scores
+	Score  float64
+	Scores map[string]float64
+}
+
+type Reranker struct {
+	candidates int
+	scorers    []Scorer
+	weights    []float64
+}
+
+// Set in main from the config. A nil Reranker asks for a
+// single candidate and keeps candidates in order.
+var Reranking *Reranker
+
+func newReranker(c *RerankConfig) (*Reranker, error) {
+	if c.Candidates < 0 {
+		return nil, errors.New("Rerank candidates can't be negative")
+	}
+	r := &Reranker{candidates: c.Candidates}
+	if r.candidates == 0 {
+		r.candidates = 1
+	}
+
+	// Sorted so ties always go the same way
+	names := []string{}
+	for name := range c.Scorers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var s Scorer
+		switch name {
+		case "length":
+			s = &LengthScorer{Min: MIN_CANDIDATE_CHARS, Max: 280}
+		case "repetition":
+			s = &RepetitionScorer{}
+		case "duplicate":
+			s = &DuplicateScorer{}
+		case "logprob":
+			s = &LogProbScorer{}
+		default:
+			return nil, fmt.Errorf("Unknown rerank scorer %q", name)
+		}
+		if c.Scorers[name] < 0 {
+			return nil, fmt.Errorf("Rerank scorer %q can't have a negative weight", name)
+		}
+		r.scorers = append(r.scorers, s)
+		r.weights = append(r.weights, c.Scorers[name])
+	}
+	return r, nil
+}
+
+func (r *Reranker) Candidates() int {
+	if r == nil {
+		return 1
+	}
+	return r.candidates
+}
+
+// Whether the completion calls need to ask for log probabilities
+func (r *Reranker) UsesLogProbs() bool {
+	if r == nil {
+		return false
+	}
+	for i, s := range r.scorers {
+		if s.Name() == "logprob" && r.weights[i] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Scores the candidates, best first. Candidates that score
+// the same keep their order.
+func (r *Reranker) Rank(candidates []Candidate, rc RerankContext) []ScoredCandidate {
+	ranked := []ScoredCandidate{}
+	for _, c := range candidates {
+		scored := ScoredCandidate{Candidate: c, Scores: map[string]float64{}}
+		if r != nil {
+			for i, s := range r.scorers {
+				score := s.Score(c, rc)
+				scored.Scores[s.Name()] = score
+				scored.Score += r.weights[i] * score
+			}
+		}
+		ranked = append(ranked, scored)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+	return ranked
+}
+
+// Prefers candidates that fit in a tweet without being curt
+type LengthScorer struct {
+	Min int
+	Max int
+}
+
+func (s *LengthScorer) Name() string { return "length" }
+
+func (s *LengthScorer) Score(c Candidate, rc RerankContext) float64 {
+	n := utf8.RuneCountInString(strings.TrimSpace(c.Text))
+	switch {
+	case n == 0 || n > s.Max:
+		return 0
+	case n < s.Min:
+		return float64(n) / float64(s.Min)
+	}
+	return 1
+}
+
+// Penalizes candidates that say what James already said earlier in
+// the thread, which completion models love to do
+type RepetitionScorer struct{}
+
+func (s *RepetitionScorer) Name() string { return "repetition" }
+
+func (s *RepetitionScorer) Score(c Candidate, rc RerankContext) float64 {
+	worst := 0.0
+	for _, line := range rc.Lines {
+		if line.IsJames {
+			worst = math.Max(worst, similarity(c.Text, line.Text))
+		}
+	}
+	return 1 - worst
+}
+
+// Penalizes candidates close to one of James's recent tweets.
+// Twitter rejects exact duplicates anyway.
+type DuplicateScorer struct{}
+
+func (s *DuplicateScorer) Name() string { return "duplicate" }
+
+func (s *DuplicateScorer) Score(c Candidate, rc RerankContext) float64 {
+	worst := 0.0
+	for _, post := range rc.Recent {
+		worst = math.Max(worst, similarity(c.Text, post))
+	}
+	return 1 - worst
+}
+
+// Prefers candidates the model was more sure about
+type LogProbScorer struct{}
+
+func (s *LogProbScorer) Name() string { return "logprob" }
+
+func (s *LogProbScorer) Score(c Candidate, rc RerankContext) float64 {
+	if c.LogProb == nil {
+		return 0
+	}
+	// The geometric mean of the token probabilities
+	return math.Exp(*c.LogProb)
+}
+
+// How many of the words two texts have in common, from 0 to 1.
+// Mentions are left out, every reply starts with one.
+func similarity(a string, b string) float64 {
+	wordsA, wordsB := words(a), words(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for w := range wordsA {
+		if wordsB[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(wordsA)+len(wordsB)-shared)
+}
+
+func words(text string) map[string]bool {
+	found := map[string]bool{}
+	for _, field := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(field, "@") {
+			continue
+		}
+		w := strings.TrimFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if w != "" {
+			found[w] = true
+		}
+	}
+	return found
+}
+
+// Mean of the token log probabilities, nil if there are none
+func meanLogProb(logprobs []float64) *float64 {
+	if len(logprobs) == 0 {
+		return nil
+	}
+	sum := 0.0
+	for _, lp := range logprobs {
+		sum += lp
+	}
+	mean := sum / float64(len(logprobs))
+	return &mean
+}
+
+// Log probabilities of a choice's tokens. The completions API fills in
+// TokenLogprobs, the chat API Content.
+type choiceLogprobs struct {
+	TokenLogprobs []float64 `json:"token_logprobs"`
+	Content       []struct {
+		Logprob float64 `json:"logprob"`
+	} `json:"content"`
+}
+
+func (l *choiceLogprobs) values() []float64 {
+	if l == nil {
+		return nil
+	}
+	values := append([]float64{}, l.TokenLogprobs...)
+	for _, c := range l.Content {
+		values = append(values, c.Logprob)
+	}
+	return values
+}
+
+// James's latest tweets, for the duplicate scorer
+type recentPosts struct {
+	mu    sync.Mutex
+	texts []string
+}
+
+var RecentPosts = &recentPosts{}
+
+func (r *recentPosts) Add(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.texts = append(r.texts, text)
+	if over := len(r.texts) - MAX_RECENT_POSTS; over > 0 {
+		r.texts = r.texts[over:]
+	}
+}
+
+func (r *recentPosts) List() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.texts...)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/robfig/cron/v3"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// What to do about runs that were missed while James was down
+type CatchUpPolicy string
+
+const (
+	// Forget about missed runs and wait for the next one
+	CatchUpSkip CatchUpPolicy = "skip"
+	// Run once right away, no matter how many runs were missed
+	CatchUpOnce CatchUpPolicy = "once"
+)
+
+type Job struct {
+	Name string
+	// Standard 5 field cron expression, i.e. "0 8 * * *"
+	Schedule string
+	// IANA zone the schedule is evaluated in, i.e. "America/Los_Angeles".
+	// Empty means UTC.
+	TimeZone string
+	// Runs are delayed by a random amount up to this, so posts
+	// don't go out at exactly the same second every day
+	Jitter  time.Duration
+	CatchUp CatchUpPolicy
+	Run     func(ctx context.Context) error
+}
+
+// Jobs James runs on a schedule, on top of the
+// scheduled posts from the config
+var SCHEDULED_JOBS = []*Job{}
+
+// Where the last run of every job is kept, so restarts
+// neither skip nor double post
+var SCHEDULER_STATE_PATH string = "scheduler_state.json"
+
+type Scheduler struct {
+	mu       sync.Mutex
+	path     string
+	lastRuns map[string]time.Time
+}
+
+func NewScheduler(path string) (*Scheduler, error) {
+	s := &Scheduler{path: path, lastRuns: map[string]time.Time{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.lastRuns)
+}
+
+// Starts a supervised goroutine per job
+func (s *Scheduler) Start(jobs []*Job) {
+	for _, job := range jobs {
+		job := job
+		go supervise("job:"+job.Name, func() error { return s.runJob(job) })
+	}
+}
+
+func (s *Scheduler) lastRun(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRuns[name]
+}
+
+func (s *Scheduler) setLastRun(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastRuns[name] = t
+	return writeJSONFile(s.path, s.lastRuns)
+}
+
+func parseJobSchedule(job *Job) (cron.Schedule, error) {
+	spec := job.Schedule
+	if job.TimeZone != "" {
+		// Fail early on unknown zones, cron would just fall back to UTC
+		if _, err := time.LoadLocation(job.TimeZone); err != nil {
+			return nil, err
+		}
+		spec = "CRON_TZ=" + job.TimeZone + " " + spec
+	}
+	return cron.ParseStandard(spec)
+}
+
+// nextRun works out when a job should run next, given when it last
+// ran (zero if never) and the current time. DST is handled by
+// evaluating the schedule in the job's own zone.
+func nextRun(job *Job, schedule cron.Schedule, last time.Time, now time.Time) time.Time {
+	if last.IsZero() {
+		return schedule.Next(now)
+	}
+
+	next := schedule.Next(last)
+	if next.After(now) {
+		return next
+	}
+
+	// Still inside the jitter window of a due run, so James restarted
+	// while waiting it out. It hasn't been missed, it's only late.
+	if now.Before(next.Add(job.Jitter)) {
+		return next
+	}
+
+	// We missed at least one run while we were down
+	if job.CatchUp == CatchUpOnce {
+		return now
+	}
+	return schedule.Next(now)
+}
+
+func (s *Scheduler) runJob(job *Job) error {
+	schedule, err := parseJobSchedule(job)
+	if err != nil {
+		return err
+	}
+
+	for {
+		now := time.Now()
+		next := nextRun(job, schedule, s.lastRun(job.Name), now)
+
+		wait := next.Sub(now)
+		if job.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(job.Jitter)))
+		}
+		slog.Info("Scheduled job", "job", job.Name, "next_run", next, "wait", wait.String())
+		time.Sleep(wait)
+
+		// The run is recorded before it happens. If James dies halfway
+		// through a post, we'd rather miss it than post it twice.
+		if err := s.setLastRun(job.Name, next); err != nil {
+			return err
+		}
+
+		ctx := withCorrelationID(context.Background(), newCorrelationID())
+		logger(ctx).Info("Running scheduled job", "job", job.Name)
+		if err := job.Run(ctx); err != nil {
+			scheduledJobRuns.WithLabelValues(job.Name, "error").Inc()
+			logger(ctx).Error("Scheduled job failed", "job", job.Name, "err", err)
+		} else {
+			scheduledJobRuns.WithLabelValues(job.Name, "ok").Inc()
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Completions are streamed and cut off as soon as FilterRegex or a
+// stop sequence shows up, so we don't pay for text that gets thrown
+// away. Can be turned off with STREAM_COMPLETIONS=false.
+var STREAM_COMPLETIONS bool = true
+
+var OPENAI_COMPLETIONS_URL string = "https://api.openai.com/v1/completions"
+
+// The API takes at most this many stop sequences, the rest are
+// only checked on our side, by the streamCutter or cutAtStops
+const MAX_API_STOPS = 4
+
+// No overall Timeout like openAIHTTP, a long stream would be cut off
+// halfway. The request ctx deadline bounds it instead.
+var openAIStreamHTTP = &http.Client{}
+
+func init() {
+	if s := os.Getenv("STREAM_COMPLETIONS"); s != "" {
+		if stream, err := strconv.ParseBool(s); err == nil {
+			STREAM_COMPLETIONS = stream
+		}
+	}
+}
+
+func apiStops(stops []string) []string {
+	if len(stops) > MAX_API_STOPS {
+		return stops[:MAX_API_STOPS]
+	}
+	return stops
+}
+
+// Cuts text at the first of stops, for completions that weren't
+// streamed and so only stopped at the first MAX_API_STOPS
+func cutAtStops(text string, stops []string) string {
+	cut := len(text)
+	for _, stop := range stops {
+		if i := strings.Index(text, stop); i >= 0 && i < cut {
+			cut = i
+		}
+	}
+	return text[:cut]
+}
+
+// Collects streamed text and finds where it has to be cut
+type streamCutter struct {
+	filter *regexp.Regexp
+	stops  []string
+	text   strings.Builder
+	cut    int
+}
+
+func newStreamCutter(filterRegex string, stops []string) (*streamCutter, error) {
+	s := &streamCutter{stops: stops, cut: -1}
+	if filterRegex != "" {
+		var err error
+		if s.filter, err = regexp.Compile(filterRegex); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Adds the next bit of the stream, returns true once
+// there's no point reading any more of it
+func (s *streamCutter) Write(chunk string) bool {
+	s.text.WriteString(chunk)
+	text := s.text.String()
+
+	cut := -1
+	if s.filter != nil {
+		if loc := s.filter.FindStringIndex(text); loc != nil {
+			cut = loc[0]
+		}
+	}
+	for _, stop := range s.stops {
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+
+	s.cut = cut
+	return cut >= 0
+}
+
+// Everything received, up to the cut
+func (s *streamCutter) Text() string {
+	if s.cut >= 0 {
+		return s.text.String()[:s.cut]
+	}
+	return s.text.String()
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type completionStreamRequest struct {
+	Model         string         `json:"model"`
+	Prompt        string         `json:"prompt"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Temperature   float32        `json:"temperature"`
+	Stop          []string       `json:"stop,omitempty"`
+	N             int            `json:"n,omitempty"`
+	Logprobs      int            `json:"logprobs,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+
+	TopP             float32        `json:"top_p,omitempty"`
+	PresencePenalty  float32        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32        `json:"frequency_penalty,omitempty"`
+	LogitBias        map[string]int `json:"logit_bias,omitempty"`
+	User             string         `json:"user,omitempty"`
+}
+
+// Every event of both APIs looks like this, text completions
+// fill in Text and chat completions fill in Delta
+type streamChunk struct {
+	Choices []struct {
+		Index int    `json:"index"`
+		Text  string `json:"text"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		Logprobs *choiceLogprobs `json:"logprobs"`
+	} `json:"choices"`
+	// Only in the last event
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// One of the candidates coming in over a stream
+type streamChoice struct {
+	cutter   *streamCutter
+	logprobs []float64
+}
+
+// Streams a completion from whichever API the model is behind
+func streamModel(ctx context.Context, m *Model, request CompletionRequest,
+	prompt string, messages []ChatMessage) ([]Candidate, Usage, error) {
+	n := request.Candidates
+	if n < 1 {
+		n = 1
+	}
+	choices := []*streamChoice{}
+	for i := 0; i < n; i++ {
+		cutter, err := newStreamCutter(request.FilterRegex, request.Stop)
+		if err != nil {
+			return nil, Usage{}, err
+		}
+		choices = append(choices, &streamChoice{cutter: cutter})
+	}
+
+	url := m.completionsURL()
+	logprobs := 0
+	if request.LogProbs {
+		logprobs = 1
+	}
+	var payload interface{} = completionStreamRequest{
+		Model:            m.ID,
+		Prompt:           prompt,
+		MaxTokens:        request.Tokens,
+		Temperature:      request.Temperature,
+		TopP:             request.TopP,
+		PresencePenalty:  request.PresencePenalty,
+		FrequencyPenalty: request.FrequencyPenalty,
+		LogitBias:        request.LogitBias,
+		User:             request.User,
+		Stop:             apiStops(request.Stop),
+		N:                n,
+		Logprobs:         logprobs,
+		Stream:           true,
+		StreamOptions:    &streamOptions{IncludeUsage: true},
+	}
+	promptSize := estimateTokens(prompt)
+	if m.Style == StyleChat {
+		url = m.chatURL()
+		payload = chatRequest{
+			Model:            m.ID,
+			Messages:         messages,
+			MaxTokens:        request.Tokens,
+			Temperature:      request.Temperature,
+			TopP:             request.TopP,
+			PresencePenalty:  request.PresencePenalty,
+			FrequencyPenalty: request.FrequencyPenalty,
+			LogitBias:        request.LogitBias,
+			User:             request.User,
+			Stop:             apiStops(request.Stop),
+			N:                n,
+			Logprobs:         request.LogProbs,
+			Stream:           true,
+			StreamOptions:    &streamOptions{IncludeUsage: true},
+		}
+		for _, message := range messages {
+			promptSize += estimateTokens(message.Content)
+		}
+	}
+
+	usage, cut, err := streamOpenAI(ctx, url, m.apiKey(), payload, choices)
+	if err != nil {
+		return nil, usage, err
+	}
+
+	candidates := []Candidate{}
+	received, kept, completionSize := 0, 0, 0
+	for _, choice := range choices {
+		candidates = append(candidates, Candidate{
+			Text:    choice.cutter.Text(),
+			LogProb: meanLogProb(choice.logprobs),
+		})
+		received += choice.cutter.text.Len()
+		kept += len(choice.cutter.Text())
+		completionSize += estimateTokens(choice.cutter.text.String())
+	}
+
+	// Cancelled streams never get to the event with the usage,
+	// so it has to be estimated
+	if cut {
+		streamsCut.WithLabelValues(m.Name).Inc()
+		usage = Usage{promptSize, completionSize}
+		requestLogger(request).Debug("Cut completion stream short", "model", m.Name,
+			"received", received, "kept", kept)
+	}
+	return candidates, usage, nil
+}
+
+// Reads server-sent events until the stream ends or every choice has
+// been cut. Returning closes the body, which is what cancels the
+// stream on OpenAI's side.
+func streamOpenAI(ctx context.Context, url string, apiKey string, payload interface{},
+	choices []*streamChoice) (usage Usage, cut bool, err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return usage, false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return usage, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := openAIStreamHTTP.Do(req)
+	if err != nil {
+		return usage, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errBody, _ := ioutil.ReadAll(resp.Body)
+		return usage, false, fmt.Errorf("Streaming completion returned %v: %s",
+			resp.StatusCode, strings.TrimSpace(string(errBody)))
+	}
+
+	remaining := len(choices)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			break
+		}
+
+		chunk := streamChunk{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return usage, false, err
+		}
+		if chunk.Usage != nil {
+			usage = Usage{chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens}
+		}
+		for _, c := range chunk.Choices {
+			if c.Index < 0 || c.Index >= len(choices) {
+				continue
+			}
+			choice := choices[c.Index]
+			if choice.cutter.cut >= 0 {
+				continue
+			}
+			choice.logprobs = append(choice.logprobs, c.Logprobs.values()...)
+			if choice.cutter.Write(c.Text + c.Delta.Content) {
+				remaining--
+			}
+		}
+		if remaining == 0 {
+			return usage, true, nil
+		}
+	}
+	return usage, false, scanner.Err()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where subscriptions are kept. Can be overridden with SUBSCRIPTIONS_PATH.
+var SUBSCRIPTIONS_PATH string = "subscriptions.json"
+
+var STAR_SIGNS = []string{
+	"Aries", "Taurus", "Gemini", "Cancer", "Leo", "Virgo",
+	"Libra", "Scorpio", "Sagittarius", "Capricorn", "Aquarius", "Pisces",
+}
+
+// Someone who asked for a scheduled post, i.e. the daily horoscope
+type Subscription struct {
+	User User   `json:"user"`
+	Sign string `json:"sign,omitempty"`
+	// Delivered as a DM instead of a reply
+	DM       bool      `json:"dm,omitempty"`
+	Since    time.Time `json:"since"`
+	LastSent time.Time `json:"last_sent"`
+}
+
+type SubscriptionStore struct {
+	mu   sync.Mutex
+	path string
+	// Topic (the subscribers of a scheduled post) to user ID
+	topics map[string]map[int64]*Subscription
+}
+
+// Subscriptions of every user. Set in main.
+var Subscriptions *SubscriptionStore
+
+func NewSubscriptionStore(path string) (*SubscriptionStore, error) {
+	s := &SubscriptionStore{path: path, topics: map[string]map[int64]*Subscription{}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.topics)
+}
+
+// Adds the subscription, or updates the sign and delivery
+// of an existing one
+func (s *SubscriptionStore) Subscribe(topic string, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.topics[topic] == nil {
+		s.topics[topic] = map[int64]*Subscription{}
+	}
+	if existing, ok := s.topics[topic][sub.User.ID]; ok {
+		sub.Since = existing.Since
+		sub.LastSent = existing.LastSent
+	}
+	s.topics[topic][sub.User.ID] = &sub
+	return writeJSONFile(s.path, s.topics)
+}
+
+// Returns false if the user wasn't subscribed
+func (s *SubscriptionStore) Unsubscribe(topic string, userID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.topics[topic][userID]; !ok {
+		return false, nil
+	}
+	delete(s.topics[topic], userID)
+	return true, writeJSONFile(s.path, s.topics)
+}
+
+// Subscribers of a topic, the ones who waited longest first,
+// so a budget that's too small still goes around everyone
+func (s *SubscriptionStore) List(topic string) []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := []Subscription{}
+	for _, sub := range s.topics[topic] {
+		subs = append(subs, *sub)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].LastSent.Equal(subs[j].LastSent) {
+			return subs[i].LastSent.Before(subs[j].LastSent)
+		}
+		return subs[i].Since.Before(subs[j].Since)
+	})
+	return subs
+}
+
+func (s *SubscriptionStore) MarkSent(topic string, userID int64, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.topics[topic][userID]
+	if !ok {
+		// Unsubscribed while the post was being made
+		return nil
+	}
+	sub.LastSent = t
+	return writeJSONFile(s.path, s.topics)
+}
+
+// "@JAMES__9000 subscribe horoscope leo", "unsubscribe horoscope",
+// "subscribe horoscope dm"
+var subscriptionCommandRegex = regexp.MustCompile(`(?i)\b(subscribe|unsubscribe)\s+(\w+)((?:\s+\w+)*)`)
+
+type SubscriptionCommand struct {
+	Subscribe bool
+	Topic     string
+	Sign      string
+	DM        bool
+}
+
+// Finds a subscription command in the text of a tweet. Only topics
+// that some scheduled post has subscribers for are recognized.
+func parseSubscriptionCommand(text string) (SubscriptionCommand, bool) {
+	match := subscriptionCommandRegex.FindStringSubmatch(text)
+	if match == nil {
+		return SubscriptionCommand{}, false
+	}
+
+	cmd := SubscriptionCommand{
+		Subscribe: strings.EqualFold(match[1], "subscribe"),
+		Topic:     strings.ToLower(match[2]),
+	}
+	if !isSubscriptionTopic(cmd.Topic) {
+		return SubscriptionCommand{}, false
+	}
+
+	for _, word := range strings.Fields(match[3]) {
+		if strings.EqualFold(word, "dm") {
+			cmd.DM = true
+		}
+		for _, sign := range STAR_SIGNS {
+			if strings.EqualFold(word, sign) {
+				cmd.Sign = sign
+			}
+		}
+	}
+	return cmd, true
+}
+
+func isSubscriptionTopic(topic string) bool {
+	for _, post := range SCHEDULED_POSTS {
+		if post.Subscribers == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Updates the subscription of whoever tweeted the command and lets
+// them know. Anyone can subscribe, not only whitelisted users, the
+// scheduled post's budget keeps that in check.
+func handleSubscriptionCommand(ctx context.Context, t Tweet, cmd SubscriptionCommand) (err error) {
+	ctx, span := tracer.Start(ctx, "james.subscription_command")
+	defer func() { endSpan(span, err) }()
+
+	log := logger(ctx).With("user_id", t.User.ID, "topic", cmd.Topic)
+
+	var confirmation string
+	if cmd.Subscribe {
+		err = Subscriptions.Subscribe(cmd.Topic, Subscription{
+			User:  t.User,
+			Sign:  cmd.Sign,
+			DM:    cmd.DM,
+			Since: time.Now(),
+		})
+		confirmation = fmt.Sprintf("You're subscribed to the daily %v", cmd.Topic)
+		if cmd.Sign != "" {
+			confirmation += " for " + cmd.Sign
+		}
+		confirmation += fmt.Sprintf(`. Tweet me "unsubscribe %v" to stop.`, cmd.Topic)
+		subscriptionCommands.WithLabelValues(cmd.Topic, "subscribe").Inc()
+	} else {
+		var existed bool
+		existed, err = Subscriptions.Unsubscribe(cmd.Topic, t.User.ID)
+		confirmation = fmt.Sprintf("You won't get the daily %v anymore.", cmd.Topic)
+		if !existed {
+			confirmation = fmt.Sprintf("You weren't subscribed to the daily %v.", cmd.Topic)
+		}
+		subscriptionCommands.WithLabelValues(cmd.Topic, "unsubscribe").Inc()
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Subscription updated", "subscribe", cmd.Subscribe, "sign", cmd.Sign, "dm", cmd.DM)
+
+	// Confirmations are replies too, otherwise flipping between
+	// subscribe and unsubscribe would make James tweet forever.
+	// The subscription still changes, only the tweet is skipped.
+	if reason, ok := ReplyLimits.Allow(t.User.ID, time.Now()); !ok {
+		eventsFiltered.WithLabelValues(reason).Inc()
+		log.Info("Not confirming subscription, reply limit reached", "reason", reason)
+		return nil
+	}
+
+	status := "@" + t.User.ScreenName + " " + confirmation
+	posted, err := Twitter.PostStatus(ctx, status, t.ID)
+	recordTweetPost("subscription", posted, err)
+	if IsDuplicateStatus(err) {
+		return nil
+	} else if err == nil {
+		ReplyLimits.Replied(t.User.ID, t.ID, time.Now())
+	}
+	return err
+}
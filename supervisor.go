@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Bounds of the wait between restarts of a failed goroutine.
+// The wait doubles after every failure that happens quickly.
+var MIN_RESTART_BACKOFF time.Duration = time.Second
+var MAX_RESTART_BACKOFF time.Duration = time.Minute
+
+// supervise runs f until it returns nil. If it panics or returns an
+// error, it's restarted after a backoff. Meant to be run with go.
+func supervise(name string, f func() error) {
+	backoff := MIN_RESTART_BACKOFF
+
+	for {
+		start := time.Now()
+		err := runRecovered(f)
+		if err == nil {
+			slog.Info("Goroutine exited", "goroutine", name)
+			return
+		}
+
+		// If it ran fine for a while this is a new problem,
+		// not the same one over and over
+		if time.Since(start) > MAX_RESTART_BACKOFF {
+			backoff = MIN_RESTART_BACKOFF
+		}
+
+		goroutineRestarts.WithLabelValues(name).Inc()
+		slog.Error("Goroutine failed, restarting", "goroutine", name,
+			"err", err, "backoff", backoff.String())
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MAX_RESTART_BACKOFF {
+			backoff = MAX_RESTART_BACKOFF
+		}
+	}
+}
+
+// Turns a panic in f into an error
+func runRecovered(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return f()
+}
+
+// Keeps a panic in a handler from taking the whole request down
+// without an answer
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				slog.Error("Panic handling request", "path", r.URL.Path,
+					"panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,6 +1,9 @@
 package main
 
-import "text/template"
+import (
+	"regexp"
+	"text/template"
+)
 
 type Line struct {
 	IsJames bool
@@ -15,8 +18,44 @@ James:@LiamTestAccoun3 Oh Mr. Porr you need to stop being so indecisive. Just pi
 
 {{range .}}{{if .IsJames}}{{"James:@LiamTestAccoun3 "}}{{println .Text "\n"}}{{else}}{{"Liam:@JAMES__9000 "}}{{println .Text " \n"}}{{end}}{{end}}James:`)
 
-var HoroscopeTmpl = "Complete the third horoscope in one sentence\n\n" +
-	"1.@liamport9 At 3:05PM today, someone is going to toss a carrot through your window\n\n" +
-	"2.@liamport9 You may want to avoid the west side of the sidewalk for a few days\n\n" +
-	"3.@liamport9 If you see a beagle walk up to you, do not pet it or pinch its ear\n\n" +
-	"4.@liamport9 "
+// A speaker label at the start of a line, like "Liam:" in StandardTmpl
+var speakerLabel = regexp.MustCompile(`(?m)^([A-Za-z][A-Za-z0-9_]*):`)
+
+// The speakers of a rendered prompt, in the order they first speak
+func promptSpeakers(prompt string) []string {
+	speakers := []string{}
+	seen := map[string]bool{}
+	for _, match := range speakerLabel.FindAllStringSubmatch(prompt, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			speakers = append(speakers, match[1])
+		}
+	}
+	return speakers
+}
+
+// A completion that starts a line with a speaker label
+// is making up the rest of the conversation
+func speakerStops(speakers []string) []string {
+	stops := []string{}
+	for _, s := range speakers {
+		stops = append(stops, "\n"+s+":")
+	}
+	return stops
+}
+
+// The persona of StandardTmpl, for chat models. The
+// conversation itself is sent as messages.
+var StandardSystem = "You are James (username @JAMES__9000), the AI assistant of Liam Porr " +
+	"(username @LiamTestAccoun3), an engineer from Texas. James is helpful, creative, clever, " +
+	"knowledgeable about myths, legends, jokes, folk tales and storytelling from all cultures, " +
+	"and very friendly. However, he is also known to make funny sarcastic remarks from time to time. " +
+	"You are talking on Twitter, so always answer with a single tweet and nothing else."
+
+// Used by the default horoscope post, see DEFAULT_SCHEDULED_POSTS
+var HoroscopeTmpl = "Complete the third horoscope in one sentence" +
+	"{{if .Sign}}, for a {{.Sign}}{{end}}\n\n" +
+	"1.@{{.User.ScreenName}} At 3:05PM today, someone is going to toss a carrot through your window\n\n" +
+	"2.@{{.User.ScreenName}} You may want to avoid the west side of the sidewalk for a few days\n\n" +
+	"3.@{{.User.ScreenName}} If you see a beagle walk up to you, do not pet it or pinch its ear\n\n" +
+	"4.@{{.User.ScreenName}} "
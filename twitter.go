@@ -1,20 +1,22 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"github.com/dghubble/oauth1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,7 +40,14 @@ type Event struct {
 }
 
 type User struct {
-	ID int64 `json:"id"`
+	ID         int64  `json:"id"`
+	ScreenName string `json:"screen_name,omitempty"`
+}
+
+// A user as returned by users/show, with their latest tweet
+type Profile struct {
+	User
+	Status *Tweet `json:"status"`
 }
 
 type Entity struct {
@@ -85,12 +94,27 @@ var USERS_TRACKING = []User{
 	LIAM_TEST_ACCT,
 }
 
+// Guards USERS_TRACKING and WHITELISTED_USERS, which can be
+// changed at runtime through the admin API
+var usersMu sync.RWMutex
+
 var TwitterApi url.URL = url.URL{
 	Scheme: "https",
 	Host:   "api.twitter.com",
 	Path:   "/1.1",
 }
 
+// Model James replies with, any name in Models. Can be
+// changed with "reply_model" in the config.
+var REPLY_MODEL string = GPT4oMini
+
+// Tried in order when REPLY_MODEL fails, from
+// "reply_fallback_models" in the config
+var REPLY_FALLBACK_MODELS []string
+
+// How replies are sampled, from "reply_sampling" in the config
+var REPLY_SAMPLING = Sampling{Temperature: 0.9}
+
 // Tweets are 280 chars max. GPT-3 output is measured
 // in tokens, which are roughly 4 english chars in length.
 // So to make sure we stay under the limit, we went a bit
@@ -116,10 +140,13 @@ func generateResponseToken(token []byte) string {
 func webhookHandler(w http.ResponseWriter, r *http.Request) {
 	switch method := r.Method; method {
 	case "GET":
-		log.Printf("webhook question response reqeust received")
+		slog.Info("Webhook CRC check received")
+		webhookEvents.WithLabelValues("crc").Inc()
 		crcToken, ok := r.URL.Query()["crc_token"]
 		if !ok {
-			panic(errors.New("Couldnt get crc_token"))
+			slog.Warn("CRC check without crc_token")
+			http.Error(w, "missing crc_token", http.StatusBadRequest)
+			return
 		}
 
 		responseToken := generateResponseToken([]byte(crcToken[0]))
@@ -130,23 +157,78 @@ func webhookHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	case "POST":
-		log.Println("Event received")
-		body, _ := ioutil.ReadAll(r.Body)
+		ctx := withCorrelationID(r.Context(), newCorrelationID())
+		ctx = withMaxRateLimitWait(ctx, WEBHOOK_MAX_RATE_LIMIT_WAIT)
+		ctx, span := tracer.Start(ctx, "james.webhook_event",
+			trace.WithAttributes(attribute.String("correlation_id", correlationID(ctx))))
+		defer span.End()
+		log := logger(ctx)
+
+		log.Info("Event received")
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Error reading event", "err", err)
+			http.Error(w, "could not read body", http.StatusBadRequest)
+			return
+		}
 
 		// This is not all thats returned in the body, but
 		// we only store the things we need to know, keeping things lean
 		resp := Event{}
-		check(json.Unmarshal([]byte(body), &resp))
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			log.Error("Error parsing event", "err", err)
+			http.Error(w, "could not parse event", http.StatusBadRequest)
+			return
+		}
 
-		if (isNormalTweet(&resp) || isMention(&resp)) && isWhitelisted(resp.TweetCreateEvents[0].User) {
-			check(postReply(resp.TweetCreateEvents[0]))
+		if len(resp.TweetCreateEvents) > 0 {
+			span.SetAttributes(attribute.Int64("tweet.id", resp.TweetCreateEvents[0].ID))
+			webhookEvents.WithLabelValues("tweet_create").Inc()
 		} else {
-			log.Printf("Event is not a mention or not whitelisted")
+			webhookEvents.WithLabelValues("other").Inc()
+		}
+
+		if isPaused() {
+			eventsFiltered.WithLabelValues("paused").Inc()
+			log.Info("Replies are paused, ignoring event")
+		} else if Spending.OverBudget(time.Now()) && !Models.AnyFree(replyModels()) {
+			// With a free model in the chain, complete falls
+			// back to it instead
+			eventsFiltered.WithLabelValues("over_budget").Inc()
+			log.Info("Over budget, ignoring event")
+		} else if !isNormalTweet(&resp) && !isMention(&resp) {
+			eventsFiltered.WithLabelValues("not_mention").Inc()
+			log.Debug("Event is not a mention")
+		} else if cmd, ok := parseSubscriptionCommand(resp.TweetCreateEvents[0].Text); ok && isMention(&resp) {
+			if err := handleSubscriptionCommand(ctx, resp.TweetCreateEvents[0], cmd); err != nil {
+				log.Error("Error handling subscription command", "err", err)
+			}
+		} else if !isWhitelisted(resp.TweetCreateEvents[0].User) {
+			eventsFiltered.WithLabelValues("not_whitelisted").Inc()
+			log.Info("Event is not whitelisted",
+				"user_id", resp.TweetCreateEvents[0].User.ID)
+		} else if err := postReply(ctx, resp.TweetCreateEvents[0]); errors.Is(err, ErrRateLimited) {
+			// Waiting any longer would only make Twitter deliver
+			// the event again while we're still on it
+			eventsFiltered.WithLabelValues("rate_limited").Inc()
+			log.Warn("Dropping event, Twitter rate limit resets too late", "err", err)
+		} else if err != nil {
+			// Twitter would only redeliver the same event, which
+			// won't go any better, so we still answer with a 200
+			log.Error("Error replying to tweet", "err", err)
 		}
 	}
 }
 
+// The models a reply tries, in order
+func replyModels() []string {
+	return append([]string{REPLY_MODEL}, REPLY_FALLBACK_MODELS...)
+}
+
 func isNormalTweet(event *Event) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
 	if len(event.TweetCreateEvents) == 0 {
 		return false
 	} else if t := event.TweetCreateEvents[0]; t.User.ID != JAMES.ID &&
@@ -160,66 +242,132 @@ func isNormalTweet(event *Event) bool {
 }
 
 func isWhitelisted(u User) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
 	for _, wlu := range WHITELISTED_USERS {
-		if u == wlu {
+		if u.ID == wlu.ID {
 			return true
 		}
 	}
 	return false
 }
 
-func postReply(t Tweet) error {
-	// TODO: maybe creating a client for every request we get is not
-	// a great idea. Might get rate limited
-	creds := Credentials{
-		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
-		ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
-		AccessToken:       os.Getenv("ACCESS_TOKEN"),
-		AccessTokenSecret: os.Getenv("ACCESS_TOKEN_SECRET"),
-	}
+func postReply(ctx context.Context, t Tweet) (err error) {
+	ctx, span := tracer.Start(ctx, "james.post_reply",
+		trace.WithAttributes(attribute.Int64("tweet.id", t.ID)))
+	defer func() { endSpan(span, err) }()
 
-	client, err := getClient(&creds)
+	log := logger(ctx).With("tweet_id", t.ID, "user_id", t.User.ID)
+	log.Info("Replying to tweet", "text", t.Text)
+
+	if reason, ok := ReplyLimits.Allow(t.User.ID, time.Now()); !ok {
+		eventsFiltered.WithLabelValues(reason).Inc()
+		log.Info("Not replying, reply limit reached", "reason", reason)
+		return nil
+	}
 
-	lines := unrollThread(t, client)
+	// Hostile prompts would only get retried until we give up,
+	// so they don't get a completion at all
+	root := t.ID
+	inputVerdict, lines, err := Moderation.CheckInput(ctx, t, func() ([]Line, error) {
+		lines, threadRoot, err := unrollThread(ctx, t, ReplyLimits.MaxThreadDepth())
+		root = threadRoot
+		return lines, err
+	})
+	if err != nil {
+		return err
+	}
+	if inputVerdict.Flagged {
+		return Moderation.RespondToFlagged(ctx, t, inputVerdict)
+	}
 
-	statusUpdateEndpoint := TwitterApi
-	statusUpdateEndpoint.Path = statusUpdateEndpoint.Path + "/" +
-		url.PathEscape("statuses") + "/" +
-		url.PathEscape("update.json")
+	if reason, ok := ReplyLimits.AllowThread(root, len(lines), time.Now()); !ok {
+		eventsFiltered.WithLabelValues(reason).Inc()
+		log.Info("Not replying, thread limit reached", "reason", reason,
+			"root_id", root, "depth", len(lines))
+		return nil
+	}
 
 	// Create the request for a text completion from GPT-3
 	// TODO: Determine template by reading the status of the
 	// mention and matching it to some template
 	responseChan := make(chan CompletionResponse, 1)
-	prompt := new(bytes.Buffer)
-	check(StandardTmpl.Execute(prompt, lines))
-
 	req := CompletionRequest{
-		Prompt:       prompt.String(),
-		FilterRegex:  `\n[a-zA-z0-9]+:`,
-		ResponseChan: responseChan,
-		Model:        Davinci,
-		//	Model:       Ada,
-		Temperature: 0.9,
-		Tokens:      MAX_TWEET_TOKENS,
+		Lines:          lines,
+		Template:       *StandardTmpl,
+		System:         StandardSystem,
+		FilterRegex:    `\n[a-zA-z0-9]+:`,
+		ResponseChan:   responseChan,
+		CorrelationID:  correlationID(ctx),
+		UserID:         t.User.ID,
+		Mentions:       []string{t.User.ScreenName},
+		Model:          REPLY_MODEL,
+		FallbackModels: REPLY_FALLBACK_MODELS,
+		Tokens:         MAX_TWEET_TOKENS,
+		Context:        ctx,
+		Enqueued:       time.Now(),
 	}
+	REPLY_SAMPLING.apply(&req)
 
 	JamesBuffer <- req
 
 	// Wait for the completion and use it to create the tweet reply
 	resp := <-responseChan
-	check(resp.Err)
+	if errors.Is(resp.Err, ErrOverBudget) {
+		// Only this user's budget, or the last event before the
+		// webhook started ignoring them
+		eventsFiltered.WithLabelValues("over_budget").Inc()
+		log.Info("Not replying, over budget", "err", resp.Err)
+		return nil
+	} else if resp.Err != nil {
+		return resp.Err
+	}
+
+	// Chat models don't always start with the mention like
+	// the examples in StandardTmpl do
+	text := resp.Response
+	if mention := "@" + t.User.ScreenName; !strings.Contains(text, mention) {
+		text = mention + " " + strings.TrimSpace(text)
+	}
+
+	// Moderation flagged every try, or post-processing left nothing
+	// of the completion, so the response is only DEFAULT_RESPONSE
+	if resp.Verdict.Flagged {
+		var ok bool
+		text, ok, err = Fallbacks.Resolve(ctx, "reply", t.ID, t.User, resp.Verdict)
+		if err != nil || !ok {
+			return err
+		}
+	}
 
 	// Tweets will only be registered as a response if the
 	// "in_reply_to_status_id" parameter is set to the tweet that
 	// is being responded to AND if the reponse itself contains a
 	// mention of the user that created the original tweet
-	query := url.Values{}
-	query.Set("status", resp.Response)
-	query.Set("in_reply_to_status_id", strconv.FormatInt(t.ID, 10))
-	statusUpdateEndpoint.RawQuery = query.Encode()
-
-	_, err = client.Post(statusUpdateEndpoint.String(), "application/json", nil)
+	posted, err := Twitter.PostStatus(ctx, text, t.ID)
+	recordTweetPost("reply", posted, err)
+	if IsDuplicateStatus(err) {
+		// Not worth failing the whole event over, we just
+		// said the same thing recently
+		log.Warn("Twitter rejected reply as a duplicate", "response", text)
+		return nil
+	} else if err != nil {
+		log.Error("Error posting reply", "err", err)
+	} else {
+		log.Info("Posted reply", "response", text, "reply_id", posted.ID, "model", resp.Model)
+		ReplyLimits.Replied(t.User.ID, root, time.Now())
+		recordConversation(Conversation{
+			TweetID:       t.ID,
+			UserID:        t.User.ID,
+			Lines:         lines,
+			Response:      text,
+			Model:         resp.Model,
+			InputVerdict:  inputVerdict,
+			OutputVerdict: resp.Verdict,
+			Time:          time.Now(),
+		})
+	}
 	return err
 }
 
@@ -227,55 +375,34 @@ func postReply(t Tweet) error {
 // comments or include multiple tweets. This function
 // will detect if there are multiple tweets preceeding
 // the one that triggered the event and include them for
-// context.
-func unrollThread(t Tweet, client *http.Client) []Line {
-	// Matches speaker and text for the template
-	lines := []Line{
-		Line{
-			IsJames: t.User == JAMES,
-			// Newlines can mess up GPT-3
-			Text: strings.ReplaceAll(t.Text, "\n", " "),
-		},
+// context. Also returns the ID of the tweet that
+// started the thread. Threads deeper than maxDepth are
+// cut off past it, see TwitterClient.Thread.
+func unrollThread(ctx context.Context, t Tweet, maxDepth int) ([]Line, int64, error) {
+	ctx, span := tracer.Start(ctx, "james.unroll_thread",
+		trace.WithAttributes(attribute.Int64("tweet.id", t.ID)))
+	defer span.End()
+
+	log := logger(ctx).With("tweet_id", t.ID)
+
+	thread, err := Twitter.Thread(ctx, t, maxDepth)
+	if err != nil {
+		endSpan(span, err)
+		return nil, 0, err
 	}
-	curr_tweet := t
-
-	for curr_tweet.InReplyToStatusID != 0 {
-		replyId := curr_tweet.InReplyToStatusID
-		getTweetEndpoint := TwitterApi
-		getTweetEndpoint.Path = getTweetEndpoint.Path + "/" +
-			url.PathEscape("statuses") + "/" +
-			url.PathEscape("show.json")
-
-		query := url.Values{}
-		query.Set("id", strconv.FormatInt(replyId, 10))
-		getTweetEndpoint.RawQuery = query.Encode()
-
-		resp, err := client.Get(getTweetEndpoint.String())
-		check(err)
-
-		body, err := ioutil.ReadAll(resp.Body)
-		check(err)
-
-		// Need to nullify the current value because if
-		// the request does not fill out a particular parameter,
-		// it wont get overwritten.
-		curr_tweet = Tweet{}
-		json.Unmarshal(body, &curr_tweet)
-		log.Println(curr_tweet)
-
-		line := Line{
-			IsJames: curr_tweet.User == JAMES,
-			Text:    strings.ReplaceAll(curr_tweet.Text, "\n", " "),
-		}
 
-		// Order matters. Make sure that as we go up to
-		// the top of the thread, new lines are added to
-		// the beginning of the list so they appear first
-		// in the prompt
-		lines = append([]Line{line}, lines...)
-		log.Println(curr_tweet.InReplyToStatusID == 0)
+	// Matches speaker and text for the template
+	lines := []Line{}
+	for _, tweet := range thread {
+		lines = append(lines, Line{
+			IsJames: tweet.User.ID == JAMES.ID,
+			// Newlines can mess up GPT-3
+			Text: strings.ReplaceAll(tweet.Text, "\n", " "),
+		})
 	}
-	return lines
+	span.SetAttributes(attribute.Int("thread.length", len(lines)))
+	log.Info("Unrolled thread", "lines", len(lines))
+	return lines, thread[0].ID, nil
 }
 
 // To differentiate a mention from other tweets is
@@ -295,216 +422,44 @@ func isMention(event *Event) bool {
 	return false
 }
 
-// This function performs the daily execution of a hororscope function
-// at the specified time
-func executeHoroscope(hour int, min int, sec int) {
-	t0 := time.Now()
-
-	// This evaluates to 8AM the following day
-	yyyy, mm, dd := t0.Date()
-	t1 := time.Date(yyyy, mm, dd+1, hour, min, sec, 0, t0.Location())
-	wait := t1.Sub(t0)
-
-	time.Sleep(wait)
-
-	dailyTimer := time.Tick(24 * time.Second)
-
-	for {
-		postHoroscope()
-		<-dailyTimer
-	}
-}
-
-func postHoroscope() {
-	// TODO: we should have a global client
-	creds := Credentials{
-		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
-		ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
-		AccessToken:       os.Getenv("ACCESS_TOKEN"),
-		AccessTokenSecret: os.Getenv("ACCESS_TOKEN_SECRET"),
-	}
-
-	client, err := getClient(&creds)
-
-	statusUpdateEndpoint := TwitterApi
-	statusUpdateEndpoint.Path = statusUpdateEndpoint.Path + "/" +
-		url.PathEscape("statuses") + "/" +
-		url.PathEscape("update.json")
-
-	responseChan := make(chan CompletionResponse, 1)
-
-	req := CompletionRequest{
-		Prompt:       HoroscopeTmpl,
-		FilterRegex:  `\n`,
-		ResponseChan: responseChan,
-		Model:        DavinciInstruct,
-		Temperature:  0.9,
-		Tokens:       MAX_TWEET_TOKENS,
-	}
-
-	JamesBuffer <- req
-
-	// Wait for the completion and use it to create the tweet reply
-	resp := <-responseChan
-	check(resp.Err)
-
-	query := url.Values{}
-	query.Set("status", resp.Response)
-	statusUpdateEndpoint.RawQuery = query.Encode()
-
-	_, err = client.Post(statusUpdateEndpoint.String(), "application/json", nil)
-	check(err)
-}
-
-func registerWebhook() {
-	// Get credentials for twitter create a client
-	creds := Credentials{
-		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
-		ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
-		AccessToken:       os.Getenv("ACCESS_TOKEN"),
-		AccessTokenSecret: os.Getenv("ACCESS_TOKEN_SECRET"),
-	}
+func registerWebhook() error {
+	ctx := context.Background()
 
-	client, err := getClient(&creds)
+	// First see if we already have registered webhooks.
+	// Otherwise, register one
+	webhooks, err := Twitter.ListWebhooks(ctx)
 	if err != nil {
-		log.Println("Error getting Twitter Client")
-		log.Println(err)
+		return err
 	}
-
-	webhkEndpt := TwitterApi
-	webhkEndpt.Path = webhkEndpt.Path + "/" +
-		url.PathEscape("account_activity") + "/" +
-		url.PathEscape("all") + "/" +
-		url.PathEscape(ENV_NAME) + "/" +
-		url.PathEscape("webhooks.json")
-
-	// First try GET to see if we already have registered webhooks.
-	// Otherwise, POST to register one
-	// We use an app client to get all the webhooks registered for this app,
-	// not just the current user context (represented by `client`)
-	appClient := &http.Client{}
-	req, _ := http.NewRequest("GET", webhkEndpt.String(), nil)
-	req.Header.Set("authorization", "Bearer "+os.Getenv("BEARER_TOKEN"))
-	resp, err := appClient.Do(req)
-	check(err)
-	body, _ := ioutil.ReadAll(resp.Body)
 	var w = new(Webhook)
 
 	// If true, no webhook is registered, make one
-	if string(body) == "[]" {
-		log.Println("No registered webhooks found, registering new one")
-		query := url.Values{}
-		query.Set("url", WEBHOOK_URL)
-		webhkEndpt.RawQuery = query.Encode()
-
-		resp, err := client.Post(webhkEndpt.String(), "application/json", nil)
-		check(err)
-
-		body, _ = ioutil.ReadAll(resp.Body)
-		check(json.Unmarshal([]byte(body), &w))
+	if len(webhooks) == 0 {
+		slog.Info("No registered webhooks found, registering new one")
+		*w, err = Twitter.CreateWebhook(ctx, WEBHOOK_URL)
+		if err != nil {
+			return err
+		}
 	} else {
-		log.Println("Registered webhook found. Reusing")
-		var getResp = new([]Webhook)
-		err = json.Unmarshal([]byte(body), &getResp)
-		check(err)
-		*w = (*getResp)[0]
+		slog.Info("Registered webhook found, reusing")
+		*w = webhooks[0]
 	}
-
-	// Subscribe to account activity for the requesting user in the
-	// environment ENV_NAME. Max of 15 users per application in free tier.
-	// Events are sent to the webhooks registered by the user `client`
+	setWebhookStatus(w)
 
 	// This subscribes to the activity on James's account
-	check(subscribe(client, ENV_NAME))
+	if err := Twitter.Subscribe(ctx); err != nil {
+		return err
+	}
 
 	// This subscribes to all activity on the test account.
 	// This allows us to respond to all tweets coming from this account
-	test_acct_creds := Credentials{
-		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
-		ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
-		AccessToken:       os.Getenv("TEST_AUTH_TOKEN"),
-		AccessTokenSecret: os.Getenv("TEST_AUTH_SECRET"),
+	testAcct, err := Twitter.WithUser(ctx, credentialsFromEnv("TEST_AUTH_TOKEN", "TEST_AUTH_SECRET"))
+	if err != nil {
+		return err
 	}
-	test_acct_client, err := getClient(&test_acct_creds)
-	check(err)
-	check(subscribe(test_acct_client, ENV_NAME))
 	//log.Println("deleting webhook")
-	//check(deleteWebhook(w.ID, client))
-
-}
-
-func subscribe(client *http.Client, envName string) error {
-	endpt := TwitterApi
-	endpt.Path = endpt.Path + "/" +
-		url.PathEscape("account_activity") + "/" +
-		url.PathEscape("all") + "/" +
-		url.PathEscape(envName) + "/" +
-		url.PathEscape("subscriptions"+".json")
-
-	// Check if the subscription exists first
-	resp, err := client.Get(endpt.String())
-	check(err)
-
-	if resp.StatusCode == 204 {
-		return nil
-	}
-
-	// Subscription doesnt exist, create it
-	log.Println("Creating subscription")
-	resp, err = client.Post(endpt.String(), "text/plain", nil)
-	check(err)
-
-	if resp.StatusCode != 204 {
-		response, _ := ioutil.ReadAll(resp.Body)
-		return errors.New("Could not subscribe environment " +
-			envName + "\nResponse: " + string(response))
-	}
-
-	// This will check to make sure the subscription POST
-	// was processed correctly (GET should return 204)
-	return subscribe(client, envName)
-}
-
-func deleteWebhook(webhookID string, client *http.Client) error {
-	endpt := TwitterApi
-	endpt.Path = endpt.Path + "/" +
-		url.PathEscape("account_activity") + "/" +
-		url.PathEscape("all") + "/" +
-		url.PathEscape(ENV_NAME) + "/" +
-		url.PathEscape("webhooks") + "/" +
-		url.PathEscape(webhookID+".json")
-
-	req, err := http.NewRequest("DELETE", endpt.String(), nil)
-	check(err)
-	_, err = client.Do(req)
-	return err
-}
-
-// getClient is a helper function that will allow
-// us to stream tweets. It takes in a credentials struct
-// pointer for authentication.
-func getClient(creds *Credentials) (*http.Client, error) {
-	// Credentials for the developer account
-	config := oauth1.NewConfig(creds.ConsumerKey, creds.ConsumerSecret)
-	// Credentials for the authenticated user
-	token := oauth1.NewToken(creds.AccessToken, creds.AccessTokenSecret)
-
-	httpClient := config.Client(oauth1.NoContext, token)
-
-	// we can retrieve the user and verify if the credentials
-	// we have used successfullly allow us to log in
-	VerifyCredentials(httpClient)
-
-	return httpClient, nil
-}
-
-func VerifyCredentials(client *http.Client) {
-	verifyURL := TwitterApi
-	verifyURL.Path = verifyURL.Path + "/" +
-		url.PathEscape("account") + "/" +
-		url.PathEscape("verify_credentials.json")
-	_, err := client.Get(verifyURL.String())
-	check(err)
+	//return Twitter.DeleteWebhook(ctx, w.ID)
+	return testAcct.Subscribe(ctx)
 }
 
 func contains(list []User, user User) bool {
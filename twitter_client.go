@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/dghubble/oauth1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TwitterClient is created once at startup and shared by everything
+// that talks to Twitter. It holds the OAuth1 client acting as a user
+// (James, unless made with WithUser) and the bearer token client acting
+// as the app, which is needed for the account activity endpoints.
+type TwitterClient struct {
+	user    *http.Client
+	app     *http.Client
+	creds   Credentials
+	bearer  *appToken
+	envName string
+	limits  *RateLimiter
+	// Whether this is James's own client, not one made with WithUser.
+	// Only James's credentials count for the readiness check.
+	primary bool
+
+	// Either "1.1" or "2", see TWITTER_API_VERSION
+	apiVersion string
+}
+
+// The Twitter client used by the rest of James. Set in main.
+var Twitter *TwitterClient
+
+// Shared by every client made with WithUser, so when the app token
+// gets refreshed they all pick it up
+type appToken struct {
+	sync.Mutex
+	token string
+}
+
+func (b *appToken) get() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.token
+}
+
+func (b *appToken) set(token string) {
+	b.Lock()
+	defer b.Unlock()
+	b.token = token
+}
+
+func credentialsFromEnv(tokenVar string, secretVar string) Credentials {
+	return Credentials{
+		ConsumerKey:       os.Getenv("CONSUMER_KEY"),
+		ConsumerSecret:    os.Getenv("CONSUMER_SECRET"),
+		AccessToken:       os.Getenv(tokenVar),
+		AccessTokenSecret: os.Getenv(secretVar),
+	}
+}
+
+// NewTwitterClient verifies the user credentials once up front. If
+// bearerToken is empty, an app token is requested with the consumer
+// key and secret instead.
+func NewTwitterClient(ctx context.Context, creds Credentials, bearerToken string, envName string) (*TwitterClient, error) {
+	tc := &TwitterClient{
+		user:    userClient(creds),
+		app:     &http.Client{},
+		creds:   creds,
+		bearer:  &appToken{token: bearerToken},
+		envName: envName,
+		limits:  NewRateLimiter(),
+		primary: true,
+
+		apiVersion: TWITTER_API_VERSION,
+	}
+
+	if bearerToken == "" {
+		if err := tc.refreshBearerToken(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tc.VerifyCredentials(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// WithUser returns a client acting as a different user that shares
+// the app credentials of tc. Used to subscribe to tracked accounts.
+func (tc *TwitterClient) WithUser(ctx context.Context, creds Credentials) (*TwitterClient, error) {
+	userTc := *tc
+	userTc.user = userClient(creds)
+	userTc.creds = creds
+	userTc.limits = NewRateLimiter()
+	userTc.primary = false
+
+	if err := userTc.VerifyCredentials(ctx); err != nil {
+		return nil, err
+	}
+	return &userTc, nil
+}
+
+func userClient(creds Credentials) *http.Client {
+	// Credentials for the developer account
+	config := oauth1.NewConfig(creds.ConsumerKey, creds.ConsumerSecret)
+	// Credentials for the authenticated user
+	token := oauth1.NewToken(creds.AccessToken, creds.AccessTokenSecret)
+
+	return config.Client(oauth1.NoContext, token)
+}
+
+// Builds an API url out of path segments, i.e.
+// endpoint("statuses", "show.json")
+func endpoint(segments ...string) url.URL {
+	u := TwitterApi
+	for _, s := range segments {
+		u.Path = u.Path + "/" + url.PathEscape(s)
+	}
+	return u
+}
+
+// All requests go through here. The body is always read and closed.
+// Calls wait if the endpoint is close to its rate limit, and are
+// retried after the window resets if they still get a 429. Any
+// non 2xx response is returned as a *TwitterError.
+func (tc *TwitterClient) do(ctx context.Context, client *http.Client, name string,
+	method string, u url.URL, attrs ...attribute.KeyValue) (*http.Response, []byte, error) {
+	return tc.doWithBody(ctx, client, name, method, u, nil, attrs...)
+}
+
+// Same as do, but sends payload as a JSON body. Only the v2 API and
+// direct messages take those.
+func (tc *TwitterClient) doWithBody(ctx context.Context, client *http.Client, name string,
+	method string, u url.URL, payload []byte, attrs ...attribute.KeyValue) (*http.Response, []byte, error) {
+	// App and user limits are counted separately
+	family := name
+	if client == tc.app {
+		family = "app." + name
+	}
+
+	refreshed := false
+	for retries := 0; ; retries++ {
+		if err := tc.limits.Wait(ctx, family); err != nil {
+			return nil, nil, err
+		}
+
+		resp, body, err := tc.doOnce(ctx, client, name, method, u, payload, attrs...)
+		if err != nil {
+			return resp, body, err
+		}
+		tc.limits.Update(family, resp)
+
+		if resp.StatusCode < 300 {
+			return resp, body, nil
+		}
+		twErr := parseTwitterError(name, resp.StatusCode, body)
+
+		if resp.StatusCode == http.StatusTooManyRequests && retries < MAX_RATE_LIMIT_RETRIES {
+			if err := tc.limits.Backoff(ctx, family, resp); err != nil {
+				return resp, body, err
+			}
+			continue
+		}
+
+		// An expired app token can be swapped for a new one
+		// without anyone noticing
+		if client == tc.app && IsExpiredToken(twErr) && !refreshed {
+			refreshed = true
+			logger(ctx).Warn("App bearer token rejected, fetching a new one")
+			if err := tc.refreshBearerToken(ctx); err == nil {
+				continue
+			}
+		}
+
+		tc.handleError(ctx, twErr)
+		return resp, body, twErr
+	}
+}
+
+// Some errors mean James can't do anything until someone steps in.
+// On a client made with WithUser they're only that user's problem.
+func (tc *TwitterClient) handleError(ctx context.Context, err *TwitterError) {
+	if !tc.primary {
+		if IsAccountSuspended(err) || IsExpiredToken(err) {
+			logger(ctx).Warn("Tracked user's account or token can't be used", "err", err)
+		}
+		return
+	}
+
+	if IsAccountSuspended(err) {
+		logger(ctx).Error("Account is suspended or locked, pausing replies", "err", err)
+		setPaused(true)
+	} else if IsExpiredToken(err) {
+		logger(ctx).Error("Twitter token is invalid or expired", "err", err)
+		setCredentialsStatus(err)
+	}
+}
+
+func (tc *TwitterClient) doOnce(ctx context.Context, client *http.Client, name string,
+	method string, u url.URL, payload []byte, attrs ...attribute.KeyValue) (*http.Response, []byte, error) {
+	ctx, span := tracer.Start(ctx, "twitter."+name, trace.WithAttributes(attrs...))
+
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		endSpan(span, err)
+		return nil, nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client == tc.app {
+		req.Header.Set("authorization", "Bearer "+tc.bearer.get())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		endSpan(span, err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	endSpan(span, err)
+	return resp, body, err
+}
+
+// Exchanges the consumer key and secret for an app-only bearer token
+func (tc *TwitterClient) refreshBearerToken(ctx context.Context) error {
+	u := TwitterApi
+	u.Path = "/oauth2/token"
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(),
+		strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(url.QueryEscape(tc.creds.ConsumerKey), url.QueryEscape(tc.creds.ConsumerSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+
+	resp, err := tc.app.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return parseTwitterError("oauth2_token", resp.StatusCode, body)
+	}
+
+	token := struct {
+		TokenType   string `json:"token_type"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return err
+	}
+	if token.TokenType != "bearer" || token.AccessToken == "" {
+		return errors.New("Could not get bearer token, got type " + token.TokenType)
+	}
+
+	tc.bearer.set(token.AccessToken)
+	slog.Info("Fetched app bearer token")
+	return nil
+}
+
+// VerifyCredentials checks that the user credentials let us log in.
+// For James's own client the result is also kept around for the
+// readiness check.
+func (tc *TwitterClient) VerifyCredentials(ctx context.Context) error {
+	_, _, err := tc.do(ctx, tc.user, "verify_credentials", "GET",
+		endpoint("account", "verify_credentials.json"))
+	if tc.primary {
+		setCredentialsStatus(err)
+	}
+	return err
+}
+
+// Thread returns t and all the tweets it replies to, oldest first.
+// With a maxDepth other than 0, it stops walking up the thread once it
+// has more than maxDepth tweets, so a deep thread costs at most that
+// many calls to find out it's too deep.
+func (tc *TwitterClient) Thread(ctx context.Context, t Tweet, maxDepth int) ([]Tweet, error) {
+	if tc.apiVersion == "2" {
+		return tc.threadV2(ctx, t, maxDepth)
+	}
+
+	// v1.1 has no way to get a conversation, so we walk
+	// up the thread one statuses/show call at a time
+	thread := []Tweet{t}
+	for curr := t; curr.InReplyToStatusID != 0; {
+		if tooDeep(thread, maxDepth) {
+			logger(ctx).Info("Thread deeper than the max depth, stopping there",
+				"max_depth", maxDepth)
+			break
+		}
+
+		replyId := curr.InReplyToStatusID
+
+		var err error
+		curr, err = tc.ShowTweet(ctx, replyId)
+		if IsTweetUnavailable(err) {
+			// Deleted or protected, so that's as far up as we can go
+			logger(ctx).Info("Ancestor tweet unavailable, stopping thread there",
+				"ancestor_id", replyId, "err", err)
+			break
+		} else if err != nil {
+			return thread, err
+		}
+		logger(ctx).Debug("Fetched ancestor tweet", "ancestor_id", replyId,
+			"user_id", curr.User.ID, "text", curr.Text)
+
+		// Order matters. Make sure that as we go up to
+		// the top of the thread, new tweets are added to
+		// the beginning of the list so they appear first
+		// in the prompt
+		thread = append([]Tweet{curr}, thread...)
+	}
+	return thread, nil
+}
+
+func tooDeep(thread []Tweet, maxDepth int) bool {
+	return maxDepth > 0 && len(thread) > maxDepth
+}
+
+func (tc *TwitterClient) ShowTweet(ctx context.Context, id int64) (Tweet, error) {
+	u := endpoint("statuses", "show.json")
+	query := url.Values{}
+	query.Set("id", strconv.FormatInt(id, 10))
+	u.RawQuery = query.Encode()
+
+	_, body, err := tc.do(ctx, tc.user, "statuses_show", "GET", u,
+		attribute.Int64("tweet.id", id))
+	if err != nil {
+		return Tweet{}, err
+	}
+
+	// If the request does not fill out a particular
+	// parameter, it stays zeroed
+	t := Tweet{}
+	err = json.Unmarshal(body, &t)
+	return t, err
+}
+
+// Looks up a user by ID, or by screen name if the ID isn't set.
+// Profile.Status is their latest tweet, or nil if they have none
+// we can see.
+func (tc *TwitterClient) ShowUser(ctx context.Context, user User) (Profile, error) {
+	u := endpoint("users", "show.json")
+	query := url.Values{}
+	if user.ID != 0 {
+		query.Set("user_id", strconv.FormatInt(user.ID, 10))
+	} else {
+		query.Set("screen_name", user.ScreenName)
+	}
+	u.RawQuery = query.Encode()
+
+	_, body, err := tc.do(ctx, tc.user, "users_show", "GET", u,
+		attribute.Int64("user.id", user.ID),
+		attribute.String("user.screen_name", user.ScreenName))
+	if err != nil {
+		return Profile{}, err
+	}
+
+	p := Profile{}
+	err = json.Unmarshal(body, &p)
+	return p, err
+}
+
+// PostStatus tweets status as the client's user. If inReplyTo isn't 0
+// the tweet is posted as a reply to that tweet. Returns the posted tweet.
+func (tc *TwitterClient) PostStatus(ctx context.Context, status string, inReplyTo int64) (Tweet, error) {
+	if tc.apiVersion == "2" {
+		return tc.postStatusV2(ctx, status, inReplyTo)
+	}
+
+	u := endpoint("statuses", "update.json")
+	query := url.Values{}
+	query.Set("status", status)
+	if inReplyTo != 0 {
+		query.Set("in_reply_to_status_id", strconv.FormatInt(inReplyTo, 10))
+	}
+	u.RawQuery = query.Encode()
+
+	_, body, err := tc.do(ctx, tc.user, "statuses_update", "POST", u,
+		attribute.Int64("tweet.in_reply_to", inReplyTo))
+	if err != nil {
+		return Tweet{}, err
+	}
+
+	t := Tweet{}
+	err = json.Unmarshal(body, &t)
+	return t, err
+}
+
+// Sends a direct message as the client's user. Like the webhooks this
+// only exists in v1.1. The recipient has to follow James or have
+// their DMs open.
+func (tc *TwitterClient) SendDirectMessage(ctx context.Context, recipientID int64, text string) error {
+	type messageCreate struct {
+		Target struct {
+			RecipientID string `json:"recipient_id"`
+		} `json:"target"`
+		MessageData struct {
+			Text string `json:"text"`
+		} `json:"message_data"`
+	}
+	payload := struct {
+		Event struct {
+			Type          string        `json:"type"`
+			MessageCreate messageCreate `json:"message_create"`
+		} `json:"event"`
+	}{}
+	payload.Event.Type = "message_create"
+	payload.Event.MessageCreate.Target.RecipientID = strconv.FormatInt(recipientID, 10)
+	payload.Event.MessageCreate.MessageData.Text = text
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = tc.doWithBody(ctx, tc.user, "direct_messages_new", "POST",
+		endpoint("direct_messages", "events", "new.json"), body,
+		attribute.Int64("user.id", recipientID))
+	return err
+}
+
+// Lists all the webhooks registered for the app in our environment,
+// not just the ones of the current user
+func (tc *TwitterClient) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	_, body, err := tc.do(ctx, tc.app, "list_webhooks", "GET",
+		endpoint("account_activity", "all", tc.envName, "webhooks.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	err = json.Unmarshal(body, &webhooks)
+	return webhooks, err
+}
+
+func (tc *TwitterClient) CreateWebhook(ctx context.Context, webhookURL string) (Webhook, error) {
+	u := endpoint("account_activity", "all", tc.envName, "webhooks.json")
+	query := url.Values{}
+	query.Set("url", webhookURL)
+	u.RawQuery = query.Encode()
+
+	_, body, err := tc.do(ctx, tc.user, "create_webhook", "POST", u)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	w := Webhook{}
+	err = json.Unmarshal(body, &w)
+	return w, err
+}
+
+func (tc *TwitterClient) DeleteWebhook(ctx context.Context, webhookID string) error {
+	_, _, err := tc.do(ctx, tc.user, "delete_webhook", "DELETE",
+		endpoint("account_activity", "all", tc.envName, "webhooks", webhookID+".json"))
+	return err
+}
+
+// Subscribe to account activity for the client's user in our
+// environment. Max of 15 users per application in free tier.
+// Events are sent to the webhooks registered by the app.
+func (tc *TwitterClient) Subscribe(ctx context.Context) error {
+	u := endpoint("account_activity", "all", tc.envName, "subscriptions.json")
+
+	// Check if the subscription exists first. If it doesn't
+	// we get a 404 back
+	resp, _, err := tc.do(ctx, tc.user, "get_subscription", "GET", u)
+	if err == nil && resp.StatusCode == 204 {
+		return nil
+	} else if err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	// Subscription doesnt exist, create it
+	slog.Info("Creating subscription", "env", tc.envName)
+	if _, _, err := tc.do(ctx, tc.user, "create_subscription", "POST", u); err != nil {
+		return err
+	}
+
+	// This will check to make sure the subscription POST
+	// was processed correctly (GET should return 204)
+	return tc.Subscribe(ctx)
+}
+
+// Removes the account activity subscription of a user. Unlike creating
+// one, this is done as the app so we don't need the user's credentials
+func (tc *TwitterClient) Unsubscribe(ctx context.Context, userID int64) error {
+	_, _, err := tc.do(ctx, tc.app, "delete_subscription", "DELETE",
+		endpoint("account_activity", "all", tc.envName, "subscriptions",
+			strconv.FormatInt(userID, 10)+".json"))
+	return err
+}
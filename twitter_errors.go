@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Error codes from https://developer.twitter.com/en/support/twitter-api/error-troubleshooting
+const (
+	CodeNoSuchPage        = 34
+	CodeUserSuspended     = 63
+	CodeAccountSuspended  = 64
+	CodeRateLimited       = 88
+	CodeInvalidToken      = 89
+	CodeNoSuchStatus      = 144
+	CodeNotAuthorized     = 179
+	CodeDuplicateStatus   = 187
+	CodeAccountLocked     = 326
+	CodeReplyToDeleted    = 385
+	CodeStatusUnavailable = 421
+	CodeStatusDeleted     = 422
+)
+
+// TwitterError is returned by every TwitterClient call that got a
+// non 2xx response. v1.1 fills in Codes, v2 usually only has messages.
+type TwitterError struct {
+	Endpoint   string
+	StatusCode int
+	Codes      []int
+	Messages   []string
+}
+
+func (e *TwitterError) Error() string {
+	return fmt.Sprintf("Twitter %v returned %v: codes %v: %v",
+		e.Endpoint, e.StatusCode, e.Codes, strings.Join(e.Messages, "; "))
+}
+
+func (e *TwitterError) HasCode(codes ...int) bool {
+	for _, c := range e.Codes {
+		for _, code := range codes {
+			if c == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *TwitterError) mentions(text string) bool {
+	for _, m := range e.Messages {
+		if strings.Contains(strings.ToLower(m), text) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTwitterError(endpoint string, status int, body []byte) *TwitterError {
+	e := &TwitterError{Endpoint: endpoint, StatusCode: status}
+
+	// v1.1 is {"errors": [{"code": 187, "message": "..."}]}, v2 is
+	// {"title": "...", "detail": "..."} with an optional errors list
+	resp := struct {
+		Errors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Detail  string `json:"detail"`
+		} `json:"errors"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		e.Messages = append(e.Messages, string(body))
+		return e
+	}
+
+	for _, err := range resp.Errors {
+		if err.Code != 0 {
+			e.Codes = append(e.Codes, err.Code)
+		}
+		if err.Message != "" {
+			e.Messages = append(e.Messages, err.Message)
+		} else if err.Detail != "" {
+			e.Messages = append(e.Messages, err.Detail)
+		}
+	}
+	if resp.Detail != "" {
+		e.Messages = append(e.Messages, resp.Detail)
+	} else if resp.Title != "" {
+		e.Messages = append(e.Messages, resp.Title)
+	}
+	return e
+}
+
+func asTwitterError(err error) (*TwitterError, bool) {
+	var e *TwitterError
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+// Twitter refuses to post the same text twice in a row
+func IsDuplicateStatus(err error) bool {
+	e, ok := asTwitterError(err)
+	return ok && (e.HasCode(CodeDuplicateStatus) || e.mentions("duplicate content"))
+}
+
+// The tweet was deleted, is protected or its author was suspended
+func IsTweetUnavailable(err error) bool {
+	e, ok := asTwitterError(err)
+	return ok && (e.StatusCode == 404 ||
+		e.HasCode(CodeNoSuchStatus, CodeNotAuthorized, CodeUserSuspended,
+			CodeReplyToDeleted, CodeStatusUnavailable, CodeStatusDeleted))
+}
+
+// James's own account is suspended or locked
+func IsAccountSuspended(err error) bool {
+	e, ok := asTwitterError(err)
+	return ok && e.HasCode(CodeAccountSuspended, CodeAccountLocked)
+}
+
+// The token used for the call was revoked or has expired
+func IsExpiredToken(err error) bool {
+	e, ok := asTwitterError(err)
+	return ok && (e.StatusCode == 401 || e.HasCode(CodeInvalidToken))
+}
+
+func IsNotFound(err error) bool {
+	e, ok := asTwitterError(err)
+	return ok && (e.StatusCode == 404 || e.HasCode(CodeNoSuchPage))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var TwitterApiV2 url.URL = url.URL{
+	Scheme: "https",
+	Host:   "api.twitter.com",
+	Path:   "/2",
+}
+
+// Version of the Twitter API used to read threads and post tweets,
+// "1.1" or "2". Can be overridden with TWITTER_API_VERSION. The account
+// activity webhooks only exist in v1.1, so those always use it.
+var TWITTER_API_VERSION string = "1.1"
+
+// Who can reply to tweets James posts through v2. Empty means
+// everyone, otherwise "mentionedUsers" or "following".
+var TWITTER_REPLY_SETTINGS string = ""
+
+// Max pages of conversation search results we go through per thread.
+// Each page holds up to 100 tweets.
+var MAX_V2_SEARCH_PAGES int = 3
+
+func init() {
+	if v := os.Getenv("TWITTER_API_VERSION"); v != "" {
+		TWITTER_API_VERSION = v
+	}
+	if TWITTER_API_VERSION != "1.1" && TWITTER_API_VERSION != "2" {
+		log.Fatalf("TWITTER_API_VERSION must be \"1.1\" or \"2\", not %q", TWITTER_API_VERSION)
+	}
+	if s := os.Getenv("TWITTER_REPLY_SETTINGS"); s != "" {
+		TWITTER_REPLY_SETTINGS = s
+	}
+}
+
+// The fields we ask for on every v2 tweet lookup
+const tweetFieldsV2 = "author_id,conversation_id,referenced_tweets,created_at"
+
+// Adds the tweets the ones we asked for reply to (or quote) under
+// includes, so every call gets us one more level up a thread
+const tweetExpansionsV2 = "referenced_tweets.id"
+
+// v2 returns IDs as strings and has no nested user object,
+// so it gets converted to a Tweet before leaving this file
+type tweetV2 struct {
+	ID               string `json:"id"`
+	Text             string `json:"text"`
+	AuthorID         string `json:"author_id"`
+	ConversationID   string `json:"conversation_id"`
+	CreatedAt        string `json:"created_at"`
+	ReferencedTweets []struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"referenced_tweets"`
+}
+
+type tweetsResponseV2 struct {
+	Data     []tweetV2 `json:"data"`
+	Includes struct {
+		Tweets []tweetV2 `json:"tweets"`
+	} `json:"includes"`
+	Meta struct {
+		NextToken string `json:"next_token"`
+	} `json:"meta"`
+}
+
+// The tweets asked for and the ones they reference
+func (r tweetsResponseV2) all() []tweetV2 {
+	return append(append([]tweetV2{}, r.Data...), r.Includes.Tweets...)
+}
+
+func (t tweetV2) repliedTo() string {
+	for _, ref := range t.ReferencedTweets {
+		if ref.Type == "replied_to" {
+			return ref.ID
+		}
+	}
+	return ""
+}
+
+func (t tweetV2) toTweet() Tweet {
+	tweet := Tweet{
+		CreatedAt: t.CreatedAt,
+		Text:      t.Text,
+	}
+	tweet.ID, _ = strconv.ParseInt(t.ID, 10, 64)
+	tweet.User.ID, _ = strconv.ParseInt(t.AuthorID, 10, 64)
+
+	tweet.InReplyToStatusID, _ = strconv.ParseInt(t.repliedTo(), 10, 64)
+	return tweet
+}
+
+func endpointV2(segments ...string) url.URL {
+	u := TwitterApiV2
+	for _, s := range segments {
+		u.Path = u.Path + "/" + url.PathEscape(s)
+	}
+	return u
+}
+
+// Looks up tweets by ID, up to 100 at a time, along with the tweets
+// they reference. Tweets that were deleted or are protected are left
+// out of the result.
+func (tc *TwitterClient) lookupTweetsV2(ctx context.Context, ids []string) (tweetsResponseV2, error) {
+	u := endpointV2("tweets")
+	query := url.Values{}
+	query.Set("ids", strings.Join(ids, ","))
+	query.Set("tweet.fields", tweetFieldsV2)
+	query.Set("expansions", tweetExpansionsV2)
+	u.RawQuery = query.Encode()
+
+	resp := tweetsResponseV2{}
+	_, body, err := tc.do(ctx, tc.app, "v2_tweets_lookup", "GET", u,
+		attribute.Int("tweet.count", len(ids)))
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(body, &resp)
+	return resp, err
+}
+
+// Finds every tweet in a conversation from the last 7 days, which is
+// as far back as recent search goes, and the tweets they reply to.
+// That usually includes the tweet that started the conversation,
+// which search itself leaves out.
+func (tc *TwitterClient) searchConversationV2(ctx context.Context, conversationID string) ([]tweetV2, error) {
+	tweets := []tweetV2{}
+	nextToken := ""
+
+	for page := 0; page < MAX_V2_SEARCH_PAGES; page++ {
+		u := endpointV2("tweets", "search", "recent")
+		query := url.Values{}
+		query.Set("query", "conversation_id:"+conversationID)
+		query.Set("tweet.fields", tweetFieldsV2)
+		query.Set("expansions", tweetExpansionsV2)
+		query.Set("max_results", "100")
+		if nextToken != "" {
+			query.Set("next_token", nextToken)
+		}
+		u.RawQuery = query.Encode()
+
+		_, body, err := tc.do(ctx, tc.app, "v2_search_recent", "GET", u,
+			attribute.String("conversation.id", conversationID))
+		if err != nil {
+			return tweets, err
+		}
+
+		resp := tweetsResponseV2{}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return tweets, err
+		}
+
+		tweets = append(tweets, resp.all()...)
+		if resp.Meta.NextToken == "" {
+			break
+		}
+		nextToken = resp.Meta.NextToken
+	}
+	return tweets, nil
+}
+
+// Instead of one request per ancestor like v1.1, we pull the whole
+// conversation at once and walk up the reply chain locally. Tweets
+// older than search covers are looked up in batches, and since every
+// lookup also brings the tweets they reply to, each call gets at least
+// two levels of the thread.
+func (tc *TwitterClient) threadV2(ctx context.Context, t Tweet, maxDepth int) ([]Tweet, error) {
+	if t.InReplyToStatusID == 0 {
+		return []Tweet{t}, nil
+	}
+	id := strconv.FormatInt(t.ID, 10)
+
+	found, err := tc.lookupTweetsV2(ctx, []string{id})
+	if err != nil {
+		return []Tweet{t}, err
+	}
+	if len(found.Data) == 0 {
+		return []Tweet{t}, errors.New("Could not look up tweet " + id)
+	}
+	conversationID := found.Data[0].ConversationID
+
+	byID := map[string]tweetV2{}
+	remember := func(tweets []tweetV2) {
+		for _, c := range tweets {
+			byID[c.ID] = c
+		}
+	}
+	remember(found.all())
+
+	conversation, err := tc.searchConversationV2(ctx, conversationID)
+	if err != nil {
+		return []Tweet{t}, err
+	}
+	remember(conversation)
+
+	// Looked up but not returned, so deleted or protected
+	unavailable := map[string]bool{}
+
+	// The tweet from the webhook already has everything we need
+	thread := []Tweet{t}
+	for curr := t; curr.InReplyToStatusID != 0; {
+		if tooDeep(thread, maxDepth) {
+			logger(ctx).Info("Thread deeper than the max depth, stopping there",
+				"max_depth", maxDepth)
+			break
+		}
+		parentID := strconv.FormatInt(curr.InReplyToStatusID, 10)
+
+		parent, ok := byID[parentID]
+		if !ok && !unavailable[parentID] {
+			missing := missingParentsV2(byID, unavailable, parentID)
+			resp, err := tc.lookupTweetsV2(ctx, missing)
+			if err != nil && !IsTweetUnavailable(err) {
+				return thread, err
+			}
+			remember(resp.all())
+			for _, m := range missing {
+				if _, ok := byID[m]; !ok {
+					unavailable[m] = true
+				}
+			}
+			parent, ok = byID[parentID]
+		}
+		if !ok {
+			// Deleted or protected, so that's as far up as we can go
+			break
+		}
+
+		curr = parent.toTweet()
+		thread = append([]Tweet{curr}, thread...)
+	}
+
+	logger(ctx).Debug("Fetched conversation through v2",
+		"conversation_id", conversationID, "conversation_size", len(conversation))
+	return thread, nil
+}
+
+// The tweets to look up when parentID is missing: parentID itself, and
+// whatever else the tweets we have reply to that we don't have yet, up
+// to the 100 a lookup takes
+func missingParentsV2(byID map[string]tweetV2, unavailable map[string]bool, parentID string) []string {
+	missing := []string{parentID}
+	seen := map[string]bool{parentID: true}
+	for _, t := range byID {
+		id := t.repliedTo()
+		if id == "" || seen[id] || unavailable[id] {
+			continue
+		}
+		if _, ok := byID[id]; ok {
+			continue
+		}
+		seen[id] = true
+		missing = append(missing, id)
+		if len(missing) == 100 {
+			break
+		}
+	}
+	return missing
+}
+
+func (tc *TwitterClient) postStatusV2(ctx context.Context, status string, inReplyTo int64) (Tweet, error) {
+	type reply struct {
+		InReplyToTweetID string `json:"in_reply_to_tweet_id"`
+	}
+	payload := struct {
+		Text          string `json:"text"`
+		Reply         *reply `json:"reply,omitempty"`
+		ReplySettings string `json:"reply_settings,omitempty"`
+	}{
+		Text:          status,
+		ReplySettings: TWITTER_REPLY_SETTINGS,
+	}
+	if inReplyTo != 0 {
+		payload.Reply = &reply{strconv.FormatInt(inReplyTo, 10)}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Tweet{}, err
+	}
+
+	_, respBody, err := tc.doWithBody(ctx, tc.user, "v2_tweets_create", "POST",
+		endpointV2("tweets"), body, attribute.Int64("tweet.in_reply_to", inReplyTo))
+	if err != nil {
+		return Tweet{}, err
+	}
+
+	resp := struct {
+		Data tweetV2 `json:"data"`
+	}{}
+	err = json.Unmarshal(respBody, &resp)
+	return resp.Data.toTweet(), err
+}